@@ -0,0 +1,268 @@
+// Package auth provides API token authentication and authorization scoped to
+// queue path prefixes.
+//
+// Tokens are loaded from a JSON file:
+//
+//	{
+//	  "identities": [
+//	    {
+//	      "name": "worker",
+//	      "token": "secret-bearer-token",
+//	      "secret": "secret-hmac-key",
+//	      "permissions": [
+//	        {"prefix": "orders", "operations": ["consume"]}
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// A request is authenticated either by "Authorization: Bearer <token>" or by
+// "Authorization: HMAC-SHA256 <name>:<signature>" where signature is the hex
+// encoded HMAC-SHA256 of "<method>\n<request uri>\n<X-Pluq-Date>\n<body hash>"
+// keyed by secret. X-Pluq-Date is the RFC 1123 date of the request and body
+// hash is the hex encoded SHA-256 of the request body. Signatures carry no
+// nonce, so a captured request can be replayed while its date is within
+// MaxClockSkew; sign requests only over TLS. Over mutual TLS,
+// an identity can also be selected by the "subject" field, which is matched
+// against the common name of the client certificate.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Operation string
+
+const (
+	Produce Operation = "produce"
+	Consume Operation = "consume"
+	// Admin allows managing queue properties. It implies the other
+	// operations.
+	Admin Operation = "admin"
+)
+
+var (
+	ErrUnauthorized = errors.New("Error unauthorized")
+	ErrForbidden    = errors.New("Error forbidden")
+)
+
+// MaxClockSkew is the maximum difference between X-Pluq-Date of a signed
+// request and the server clock. It is also the window in which a signed
+// request can be replayed.
+var MaxClockSkew = 5 * time.Minute
+
+type Permission struct {
+	Prefix     string      `json:"prefix"`
+	Operations []Operation `json:"operations"`
+}
+
+func (p *Permission) allows(op Operation) bool {
+	for _, v := range p.Operations {
+		if v == op || v == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Permission) covers(queue string) bool {
+	prefix := strings.Trim(p.Prefix, "/")
+	if prefix == "" || queue == prefix {
+		return true
+	}
+	return strings.HasPrefix(queue, prefix+"/")
+}
+
+type Identity struct {
+	Name   string `json:"name"`
+	Token  string `json:"token,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	// Subject is the common name of a client certificate which identifies
+	// the identity over mutual TLS.
+	Subject     string       `json:"subject,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Allowed reports whether the identity may perform op on the queue.
+func (i *Identity) Allowed(op Operation, queue string) bool {
+	for _, p := range i.Permissions {
+		if p.allows(op) && p.covers(queue) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedAny reports whether the identity may perform op on any queue. It is
+// used for requests that don't specify a queue such as acknowledgement.
+func (i *Identity) AllowedAny(op Operation) bool {
+	for _, p := range i.Permissions {
+		if p.allows(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// token is a bearer token kept by its hash so that it can be compared in
+// constant time.
+type token struct {
+	sum [sha256.Size]byte
+	id  *Identity
+}
+
+type Store struct {
+	names    map[string]*Identity
+	tokens   []token
+	subjects map[string]*Identity
+}
+
+func NewStore(ids []*Identity) (*Store, error) {
+	s := &Store{
+		names:    make(map[string]*Identity),
+		subjects: make(map[string]*Identity),
+	}
+	for _, id := range ids {
+		if id.Name == "" {
+			return nil, errors.New("identity name is required")
+		}
+		if _, ok := s.names[id.Name]; ok {
+			return nil, fmt.Errorf("duplicate identity: %s", id.Name)
+		}
+		s.names[id.Name] = id
+		if id.Token != "" {
+			if s.lookupToken(id.Token) != nil {
+				return nil, fmt.Errorf("duplicate token: %s", id.Name)
+			}
+			s.tokens = append(s.tokens, token{sum: sha256.Sum256([]byte(id.Token)), id: id})
+		}
+		if id.Subject != "" {
+			if _, ok := s.subjects[id.Subject]; ok {
+				return nil, fmt.Errorf("duplicate subject: %s", id.Name)
+			}
+			s.subjects[id.Subject] = id
+		}
+	}
+	return s, nil
+}
+
+// Load reads identities from the JSON file.
+func Load(path string) (*Store, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Identities []*Identity `json:"identities"`
+	}
+	if err = json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	return NewStore(file.Identities)
+}
+
+// Lookup returns the identity with the name.
+func (s *Store) Lookup(name string) *Identity {
+	return s.names[name]
+}
+
+// lookupToken returns the identity of the bearer token. All tokens are
+// compared in constant time so that the timing does not tell how much of a
+// token matched.
+func (s *Store) lookupToken(cred string) *Identity {
+	sum := sha256.Sum256([]byte(cred))
+	var found *Identity
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(t.sum[:], sum[:]) == 1 {
+			found = t.id
+		}
+	}
+	return found
+}
+
+// Authenticate returns the identity of the request. If the request has no
+// Authorization header, the verified client certificate is used instead.
+func (s *Store) Authenticate(r *http.Request) (*Identity, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		if name := CertificateSubject(r); name != "" {
+			if id := s.subjects[name]; id != nil {
+				return id, nil
+			}
+		}
+		return nil, ErrUnauthorized
+	}
+	i := strings.IndexByte(h, ' ')
+	if i < 0 {
+		return nil, ErrUnauthorized
+	}
+	switch scheme, cred := h[:i], strings.TrimSpace(h[i+1:]); scheme {
+	case "Bearer":
+		if id := s.lookupToken(cred); id != nil {
+			return id, nil
+		}
+	case "HMAC-SHA256":
+		return s.verifySignature(r, cred)
+	}
+	return nil, ErrUnauthorized
+}
+
+func (s *Store) verifySignature(r *http.Request, cred string) (*Identity, error) {
+	i := strings.LastIndexByte(cred, ':')
+	if i < 0 {
+		return nil, ErrUnauthorized
+	}
+	id := s.names[cred[:i]]
+	if id == nil || id.Secret == "" {
+		return nil, ErrUnauthorized
+	}
+	date := r.Header.Get("X-Pluq-Date")
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	if d := time.Since(t); d > MaxClockSkew || d < -MaxClockSkew {
+		return nil, ErrUnauthorized
+	}
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := Sign(id.Secret, r.Method, r.URL.RequestURI(), date, body)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(cred[i+1:])) != 1 {
+		return nil, ErrUnauthorized
+	}
+	return id, nil
+}
+
+// Sign returns the signature of a request for HMAC-SHA256 authentication.
+func Sign(secret, method, uri, date string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, uri, date, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CertificateSubject returns the common name of the verified client
+// certificate, or an empty string if the request has none.
+func CertificateSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
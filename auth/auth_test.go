@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	s, err := NewStore([]*Identity{
+		{
+			Name:  "producer",
+			Token: "ptoken",
+			Permissions: []Permission{
+				{Prefix: "orders", Operations: []Operation{Produce}},
+			},
+		},
+		{
+			Name:    "consumer",
+			Subject: "worker.example.com",
+			Permissions: []Permission{
+				{Prefix: "orders", Operations: []Operation{Consume}},
+			},
+		},
+		{
+			Name:   "admin",
+			Secret: "asecret",
+			Permissions: []Permission{
+				{Prefix: "", Operations: []Operation{Admin}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAllowed(t *testing.T) {
+	s := newTestStore(t)
+	p := s.Lookup("producer")
+	for _, c := range []struct {
+		op      Operation
+		queue   string
+		allowed bool
+	}{
+		{Produce, "orders", true},
+		{Produce, "orders/eu", true},
+		{Produce, "ordersx", false},
+		{Produce, "", false},
+		{Consume, "orders", false},
+	} {
+		if got := p.Allowed(c.op, c.queue); got != c.allowed {
+			t.Errorf("Allowed(%s, %q) = %v", c.op, c.queue, got)
+		}
+	}
+	if !p.AllowedAny(Produce) || p.AllowedAny(Consume) {
+		t.Errorf("Unexpected AllowedAny result")
+	}
+
+	a := s.Lookup("admin")
+	for _, op := range []Operation{Produce, Consume, Admin} {
+		if !a.Allowed(op, "any/queue") {
+			t.Errorf("Admin is not allowed to %s", op)
+		}
+	}
+}
+
+func TestDuplicateIdentity(t *testing.T) {
+	_, err := NewStore([]*Identity{{Name: "a"}, {Name: "a"}})
+	if err == nil {
+		t.Fatal("Error expected")
+	}
+	_, err = NewStore([]*Identity{{Name: "a", Token: "t"}, {Name: "b", Token: "t"}})
+	if err == nil {
+		t.Fatal("Error expected for duplicate token")
+	}
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	s := newTestStore(t)
+	r, _ := http.NewRequest("GET", "/v1/queues/orders", nil)
+	if _, err := s.Authenticate(r); err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized but %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := s.Authenticate(r); err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized but %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer ptoken")
+	id, err := s.Authenticate(r)
+	if err != nil || id.Name != "producer" {
+		t.Fatalf("Unexpected result: %v, %v", id, err)
+	}
+}
+
+func TestAuthenticateHMAC(t *testing.T) {
+	s := newTestStore(t)
+	r, _ := http.NewRequest("PUT", "/v1/properties/a?x=1", nil)
+	date := time.Now().UTC().Format(http.TimeFormat)
+	r.Header.Set("X-Pluq-Date", date)
+	r.Header.Set("Authorization", "HMAC-SHA256 admin:"+Sign("asecret", "PUT", "/v1/properties/a?x=1", date, nil))
+	id, err := s.Authenticate(r)
+	if err != nil || id.Name != "admin" {
+		t.Fatalf("Unexpected result: %v, %v", id, err)
+	}
+
+	r.Header.Set("Authorization", "HMAC-SHA256 admin:"+Sign("wrong", "PUT", "/v1/properties/a?x=1", date, nil))
+	if _, err = s.Authenticate(r); err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized but %v", err)
+	}
+
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"retry":3}`))
+	r.Header.Set("Authorization", "HMAC-SHA256 admin:"+Sign("asecret", "PUT", "/v1/properties/a?x=1", date, []byte(`{"retry":1}`)))
+	if _, err = s.Authenticate(r); err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized for tampered body but %v", err)
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"retry":3}`))
+	r.Header.Set("Authorization", "HMAC-SHA256 admin:"+Sign("asecret", "PUT", "/v1/properties/a?x=1", date, []byte(`{"retry":3}`)))
+	if _, err = s.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != `{"retry":3}` {
+		t.Fatalf("Body is not restored: %s", b)
+	}
+
+	date = time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	r.Header.Set("X-Pluq-Date", date)
+	r.Header.Set("Authorization", "HMAC-SHA256 admin:"+Sign("asecret", "PUT", "/v1/properties/a?x=1", date, nil))
+	if _, err = s.Authenticate(r); err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized but %v", err)
+	}
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	s := newTestStore(t)
+	r, _ := http.NewRequest("GET", "/v1/queues/orders", nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "worker.example.com"}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	id, err := s.Authenticate(r)
+	if err != nil || id.Name != "consumer" {
+		t.Fatalf("Unexpected result: %v, %v", id, err)
+	}
+
+	cert.Subject.CommonName = "unknown"
+	if _, err = s.Authenticate(r); err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized but %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package auth
+
+import "golang.org/x/net/context"
+
+type key int
+
+const (
+	storeKey key = iota
+	identityKey
+)
+
+func NewContext(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey, s)
+}
+
+func FromContext(ctx context.Context) *Store {
+	if s, ok := ctx.Value(storeKey).(*Store); ok {
+		return s
+	}
+	return nil
+}
+
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+func IdentityFromContext(ctx context.Context) *Identity {
+	if id, ok := ctx.Value(identityKey).(*Identity); ok {
+		return id
+	}
+	return nil
+}
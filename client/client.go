@@ -0,0 +1,359 @@
+// Package client provides a Go client for the pluq HTTP API.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/types"
+	"golang.org/x/net/context"
+)
+
+var ErrEmpty = errors.New("Error empty queue")
+
+// Error is returned when the server responds with an unexpected status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pluq: %d %s", e.StatusCode, e.Message)
+}
+
+type Message struct {
+	ContentType string
+	Body        []byte
+}
+
+type Envelope struct {
+	// ID is the ephemeral ID to ack, extend or release the envelope.
+	ID string
+	// OriginalID is the message ID which stays the same across deliveries.
+	OriginalID string
+	Queue      string
+	Retry      types.Retry
+	Timeout    types.Duration
+	// DeliveryCount is the number of deliveries including this one.
+	DeliveryCount int
+	EnqueuedAt    time.Time
+	AccumKey      string
+	Messages      []*Message
+}
+
+func (e *Envelope) IsComposite() bool {
+	return len(e.Messages) > 1
+}
+
+type PushOptions struct {
+	ContentType string
+	Properties  *queue.Properties
+	// AccumKey groups accumulated messages into windows per key.
+	AccumKey string
+	// DedupKey identifies the message for accum_coalesce instead of the
+	// body.
+	DedupKey string
+}
+
+type PushResult struct {
+	AccumState string `json:"accum_state"`
+	// Flushed is true if the push made the accumulating envelope available.
+	Flushed bool `json:"flushed"`
+}
+
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+	// Token is sent as a bearer token if not empty.
+	Token string
+}
+
+func New(url string) *Client {
+	return &Client{
+		URL:        strings.TrimRight(url, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) Push(name string, body []byte, opts *PushOptions) (map[string]*PushResult, error) {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	v := url.Values{}
+	if p := opts.Properties; p != nil {
+		if p.Retry != nil {
+			v.Set("retry", p.Retry.String())
+		}
+		if p.Timeout != nil {
+			v.Set("timeout", p.Timeout.String())
+		}
+		if p.AccumTime != nil {
+			v.Set("accum_time", p.AccumTime.String())
+		}
+		if p.AccumMode != nil {
+			v.Set("accum_mode", *p.AccumMode)
+		}
+		if p.AccumMaxWait != nil {
+			v.Set("accum_max_wait", p.AccumMaxWait.String())
+		}
+		if p.AccumCoalesce != nil {
+			v.Set("accum_coalesce", strconv.FormatBool(*p.AccumCoalesce))
+		}
+		if p.AccumMaxMessages != nil {
+			v.Set("accum_max_messages", strconv.Itoa(*p.AccumMaxMessages))
+		}
+		if p.AccumMaxBytes != nil {
+			v.Set("accum_max_bytes", strconv.Itoa(*p.AccumMaxBytes))
+		}
+	}
+	if opts.AccumKey != "" {
+		v.Set("accum_key", opts.AccumKey)
+	}
+	if opts.DedupKey != "" {
+		v.Set("dedup_key", opts.DedupKey)
+	}
+	req, err := http.NewRequest("POST", c.endpoint("/v1/queues/"+name, v), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	results := make(map[string]*PushResult)
+	if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Pop dequeues an envelope from the queue. If wait is positive, the server
+// holds the request until a message becomes available or wait elapses. It
+// returns ErrEmpty if there is no message.
+func (c *Client) Pop(name string, wait time.Duration) (*Envelope, error) {
+	return c.PopContext(context.Background(), name, wait)
+}
+
+func (c *Client) PopContext(ctx context.Context, name string, wait time.Duration) (*Envelope, error) {
+	v := url.Values{}
+	if wait > 0 {
+		v.Set("wait", wait.String())
+	}
+	return c.pop(ctx, c.endpoint("/v1/queues/"+name, v))
+}
+
+// PopAny pops from the first of the queues having a message.
+func (c *Client) PopAny(ctx context.Context, names []string, wait time.Duration) (*Envelope, error) {
+	v := url.Values{"queue": names}
+	if wait > 0 {
+		v.Set("wait", wait.String())
+	}
+	return c.pop(ctx, c.endpoint("/v1/pop", v))
+}
+
+func (c *Client) pop(ctx context.Context, u string) (*Envelope, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, ErrEmpty
+	}
+	return readEnvelope(resp)
+}
+
+func (c *Client) Ack(id string) error {
+	return c.call("DELETE", "/v1/messages/"+id, nil)
+}
+
+// Extend extends the lease of a popped envelope so that it stays invisible
+// to other consumers for timeout from now.
+func (c *Client) Extend(id string, timeout time.Duration) error {
+	v := url.Values{}
+	v.Set("timeout", timeout.String())
+	return c.call("POST", "/v1/messages/"+id+"/extend", v)
+}
+
+// Release gives up the lease of a popped envelope so that it can be
+// redelivered immediately.
+func (c *Client) Release(id string) error {
+	return c.call("POST", "/v1/messages/"+id+"/release", nil)
+}
+
+// Flush makes the accumulating envelopes of the queue available now. It
+// returns the number of flushed envelopes per queue.
+func (c *Client) Flush(name string) (map[string]int, error) {
+	req, err := http.NewRequest("POST", c.endpoint("/v1/flush/"+name, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	flushed := make(map[string]int)
+	if err = json.NewDecoder(resp.Body).Decode(&flushed); err != nil {
+		return nil, err
+	}
+	return flushed, nil
+}
+
+// Properties returns the properties of the queue. It returns nil if no
+// properties are set.
+func (c *Client) Properties(name string, inherit bool) (*queue.Properties, error) {
+	v := url.Values{}
+	if inherit {
+		v.Set("inherit", "true")
+	}
+	req, err := http.NewRequest("GET", c.endpoint("/v1/properties/"+name, v), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	props := queue.NewProperties()
+	if err = json.NewDecoder(resp.Body).Decode(props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func (c *Client) SetProperties(name string, props *queue.Properties) error {
+	b, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", c.endpoint("/v1/properties/"+name, nil), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) call(method, path string, v url.Values) error {
+	req, err := http.NewRequest(method, c.endpoint(path, v), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	return resp, nil
+}
+
+func (c *Client) endpoint(path string, v url.Values) string {
+	u := (&url.URL{Path: path}).EscapedPath()
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	return c.URL + u
+}
+
+func readEnvelope(resp *http.Response) (*Envelope, error) {
+	e := &Envelope{
+		ID:         resp.Header.Get("X-Pluq-Message-Id"),
+		OriginalID: resp.Header.Get("X-Pluq-Original-Id"),
+		Queue:      resp.Header.Get("X-Pluq-Queue-Name"),
+		AccumKey:   resp.Header.Get("X-Pluq-Accum-Key"),
+	}
+	var err error
+	if s := resp.Header.Get("X-Pluq-Delivery-Count"); s != "" {
+		if e.DeliveryCount, err = strconv.Atoi(s); err != nil {
+			return nil, err
+		}
+	}
+	if s := resp.Header.Get("X-Pluq-Enqueued-At"); s != "" {
+		if e.EnqueuedAt, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, err
+		}
+	}
+	if s := resp.Header.Get("X-Pluq-Retry-Remaining"); s != "" {
+		if e.Retry, err = types.ParseRetry(s); err != nil {
+			return nil, err
+		}
+	}
+	if s := resp.Header.Get("X-Pluq-Timeout"); s != "" {
+		if e.Timeout, err = types.ParseDuration(s); err != nil {
+			return nil, err
+		}
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if mt, params, err := mime.ParseMediaType(ct); err == nil && mt == "multipart/mixed" {
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return e, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			b, err := ioutil.ReadAll(p)
+			if err != nil {
+				return nil, err
+			}
+			e.Messages = append(e.Messages, &Message{
+				ContentType: p.Header.Get("Content-Type"),
+				Body:        b,
+			})
+		}
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	e.Messages = []*Message{{ContentType: ct, Body: b}}
+	return e, nil
+}
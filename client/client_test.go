@@ -0,0 +1,245 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/server"
+	"github.com/yosisa/pluq/storage/memory"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+	"golang.org/x/net/context"
+)
+
+var c *Client
+
+func TestMain(m *testing.M) {
+	idgen, err := uid.NewGenerator(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := queue.NewContext(context.Background(), queue.NewManager(idgen, memory.New()))
+	go event.Dispatch()
+	ts := httptest.NewServer(server.New(ctx))
+	c = New(ts.URL)
+	code := m.Run()
+	ts.Close()
+	os.Exit(code)
+}
+
+func TestPushPopAck(t *testing.T) {
+	if _, err := c.Pop("push", 0); err != ErrEmpty {
+		t.Fatalf("Expected ErrEmpty but %v", err)
+	}
+	results, err := c.Push("push", []byte("hello"), &PushOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results["push"]; r == nil || r.AccumState != "disabled" {
+		t.Fatalf("Unexpected push result: %v", results)
+	}
+
+	e, err := c.Pop("push", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Queue != "push" || e.IsComposite() || string(e.Messages[0].Body) != "hello" {
+		t.Fatalf("Unexpected envelope: %+v", e)
+	}
+	if e.Messages[0].ContentType != "text/plain" {
+		t.Fatalf("Expected text/plain but %s", e.Messages[0].ContentType)
+	}
+	if e.Timeout != types.Duration(30*time.Second) {
+		t.Fatalf("Expected 30s but %v", e.Timeout)
+	}
+	if err = c.Ack(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ack(e.ID); err == nil {
+		t.Fatal("Error expected")
+	}
+}
+
+func TestPopAny(t *testing.T) {
+	names := []string{"any-high", "any-normal", "any-low"}
+	for _, name := range []string{"any-low", "any-normal"} {
+		if _, err := c.Push(name, []byte(name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"any-normal", "any-low"} {
+		e, err := c.PopAny(context.Background(), names, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Queue != want {
+			t.Fatalf("Expected %s but %s", want, e.Queue)
+		}
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Push("any-high", []byte("high"), nil)
+	}()
+	e, err := c.PopAny(context.Background(), names, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Queue != "any-high" {
+		t.Fatalf("Expected any-high but %s", e.Queue)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	opts := &PushOptions{
+		ContentType: "text/plain",
+		Properties:  queue.NewProperties().SetAccumTime(types.Duration(50 * time.Millisecond)),
+	}
+	for _, s := range []string{"a", "b"} {
+		if _, err := c.Push("composite", []byte(s), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	e, err := c.Pop("composite", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsComposite() || string(e.Messages[0].Body) != "a" || string(e.Messages[1].Body) != "b" {
+		t.Fatalf("Unexpected envelope: %+v", e)
+	}
+}
+
+func TestReleaseAndExtend(t *testing.T) {
+	if _, err := c.Push("release", []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.Pop("release", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Extend(e.ID, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Release(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = c.Pop("release", 0); err != nil {
+		t.Fatal(err)
+	}
+	if e.Retry != 9 {
+		t.Fatalf("Expected retry 9 but %v", e.Retry)
+	}
+	if e.DeliveryCount != 2 {
+		t.Fatalf("Expected delivery count 2 but %d", e.DeliveryCount)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	props, err := c.Properties("a/b", false)
+	if err != nil || props != nil {
+		t.Fatalf("Expected no properties but %v, %v", props, err)
+	}
+	if err = c.SetProperties("a", queue.NewProperties().SetRetry(3)); err != nil {
+		t.Fatal(err)
+	}
+	if props, err = c.Properties("a/b", true); err != nil {
+		t.Fatal(err)
+	}
+	if props.Retry == nil || *props.Retry != 3 {
+		t.Fatalf("Unexpected properties: %+v", props)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	for _, s := range []string{"ok", "fail"} {
+		if _, err := c.Push("consumer", []byte(s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var m sync.Mutex
+	seen := make(map[string]int)
+	consumer := NewConsumer(c, "consumer", HandlerFunc(func(e *Envelope) error {
+		m.Lock()
+		defer m.Unlock()
+		body := string(e.Messages[0].Body)
+		seen[body]++
+		if body == "fail" && seen[body] == 1 {
+			return errors.New("failed")
+		}
+		if seen["ok"] == 1 && seen["fail"] == 2 {
+			cancel()
+		}
+		return nil
+	}))
+	consumer.Concurrency = 2
+	consumer.Wait = 100 * time.Millisecond
+	consumer.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	done := make(chan struct{})
+	go func() {
+		consumer.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consumer didn't finish")
+	}
+	if _, err := c.Pop("consumer", 0); err != ErrEmpty {
+		t.Fatalf("Expected ErrEmpty but %v", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	resp, err := http.Get(c.URL + "/v1/events?queue=events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Unexpected content type %s", ct)
+	}
+
+	if _, err := c.Push("other", []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Push("events/a", []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.Pop("events/a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ack(e.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for _, typ := range []string{"pushed", "popped", "acked"} {
+		var ev struct {
+			Type          string `json:"type"`
+			Queue         string `json:"queue"`
+			MessageID     string `json:"message_id"`
+			DeliveryCount int    `json:"delivery_count"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != typ || ev.Queue != "events/a" || ev.MessageID != e.OriginalID {
+			t.Fatalf("Expected %s event of %s but %+v", typ, e.OriginalID, ev)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	DefaultWait        = 30 * time.Second
+	DefaultErrorPause  = time.Second
+	DefaultConcurrency = 1
+)
+
+type Handler interface {
+	HandleEnvelope(*Envelope) error
+}
+
+type HandlerFunc func(*Envelope) error
+
+func (f HandlerFunc) HandleEnvelope(e *Envelope) error {
+	return f(e)
+}
+
+// Consumer pops envelopes from a queue and passes them to a handler. An
+// envelope is acked when the handler returns nil and released for
+// redelivery otherwise. While the handler is running, the lease of the
+// envelope is extended periodically.
+type Consumer struct {
+	Client      *Client
+	Queue       string
+	Handler     Handler
+	Concurrency int
+	Wait        time.Duration
+	ErrorLog    *log.Logger
+}
+
+func NewConsumer(c *Client, name string, h Handler) *Consumer {
+	return &Consumer{
+		Client:      c,
+		Queue:       name,
+		Handler:     h,
+		Concurrency: DefaultConcurrency,
+		Wait:        DefaultWait,
+	}
+}
+
+// Run starts the consumer loop and blocks until ctx is done and all running
+// handlers have returned.
+func (c *Consumer) Run(ctx context.Context) {
+	n := c.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			c.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *Consumer) loop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		e, err := c.Client.PopContext(ctx, c.Queue, c.Wait)
+		switch err {
+		case nil:
+			c.handle(e)
+		case ErrEmpty:
+		default:
+			if ctx.Err() != nil {
+				return
+			}
+			c.logf("pop %s: %v", c.Queue, err)
+			select {
+			case <-time.After(DefaultErrorPause):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (c *Consumer) handle(e *Envelope) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go c.keepAlive(e, done, stopped)
+	err := c.Handler.HandleEnvelope(e)
+	close(done)
+	<-stopped
+	if err != nil {
+		c.logf("handle %s: %v", e.ID, err)
+		if err = c.Client.Release(e.ID); err != nil {
+			c.logf("release %s: %v", e.ID, err)
+		}
+		return
+	}
+	if err = c.Client.Ack(e.ID); err != nil {
+		c.logf("ack %s: %v", e.ID, err)
+	}
+}
+
+func (c *Consumer) keepAlive(e *Envelope, done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	timeout := time.Duration(e.Timeout)
+	if timeout <= 0 {
+		<-done
+		return
+	}
+	tick := time.NewTicker(timeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := c.Client.Extend(e.ID, timeout); err != nil {
+				c.logf("extend %s: %v", e.ID, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *Consumer) logf(format string, v ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
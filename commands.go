@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jawher/mow.cli"
+	"github.com/yosisa/pluq/client"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/types"
+)
+
+// exitEmpty is the exit status of pop when the queue is empty.
+const exitEmpty = 2
+
+func clientCommands(app *cli.Cli) {
+	app.Command("push", "Push a message read from stdin", cmdPush)
+	app.Command("pop", "Pop a message and write its body to stdout", cmdPop)
+	app.Command("ack", "Acknowledge a popped message", cmdAck)
+	app.Command("flush", "Make accumulating envelopes available now", cmdFlush)
+	app.Command("props", "Manage queue properties", func(cmd *cli.Cmd) {
+		cmd.Command("get", "Show properties of a queue", cmdPropsGet)
+		cmd.Command("set", "Set properties of a queue", cmdPropsSet)
+	})
+}
+
+// clientOpts registers options to connect to a server and returns a function
+// that creates a client from them.
+func clientOpts(cmd *cli.Cmd) func() *client.Client {
+	server := cmd.String(cli.StringOpt{
+		Name:   "s server",
+		Value:  "http://localhost:3900",
+		Desc:   "URL of the pluq server",
+		EnvVar: "PLUQ_SERVER",
+	})
+	token := cmd.String(cli.StringOpt{
+		Name:   "token",
+		Desc:   "API token for authentication",
+		EnvVar: "PLUQ_TOKEN",
+	})
+	return func() *client.Client {
+		c := client.New(*server)
+		c.Token = *token
+		return c
+	}
+}
+
+type propertyOpts struct {
+	retry     *string
+	timeout   *string
+	accumTime *string
+}
+
+func newPropertyOpts(cmd *cli.Cmd) *propertyOpts {
+	return &propertyOpts{
+		retry:     cmd.StringOpt("retry", "", "Number of retries (or nolimit)"),
+		timeout:   cmd.StringOpt("timeout", "", "Timeout until redelivery"),
+		accumTime: cmd.StringOpt("accum-time", "", "Accumulation time for composite messages"),
+	}
+}
+
+// properties builds queue properties from the options. It returns nil if no
+// option is given.
+func (o *propertyOpts) properties() (*queue.Properties, error) {
+	if *o.retry == "" && *o.timeout == "" && *o.accumTime == "" {
+		return nil, nil
+	}
+	props := queue.NewProperties()
+	if *o.retry != "" {
+		n, err := types.ParseRetry(*o.retry)
+		if err != nil {
+			return nil, err
+		}
+		props.SetRetry(n)
+	}
+	if *o.timeout != "" {
+		d, err := types.ParseDuration(*o.timeout)
+		if err != nil {
+			return nil, err
+		}
+		props.SetTimeout(d)
+	}
+	if *o.accumTime != "" {
+		d, err := types.ParseDuration(*o.accumTime)
+		if err != nil {
+			return nil, err
+		}
+		props.SetAccumTime(d)
+	}
+	return props, nil
+}
+
+func cmdPush(cmd *cli.Cmd) {
+	cmd.Spec = "[OPTIONS] QUEUE"
+	newClient := clientOpts(cmd)
+	contentType := cmd.StringOpt("t content-type", "", "Content type of the message")
+	accumKey := cmd.StringOpt("accum-key", "", "Accumulate only with messages of the same key")
+	dedupKey := cmd.StringOpt("dedup-key", "", "Identify the message by the key when coalescing")
+	popts := newPropertyOpts(cmd)
+	name := cmd.StringArg("QUEUE", "", "Queue name")
+	cmd.Action = func() {
+		props, err := popts.properties()
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		results, err := newClient().Push(*name, b, &client.PushOptions{
+			ContentType: *contentType,
+			Properties:  props,
+			AccumKey:    *accumKey,
+			DedupKey:    *dedupKey,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(results)
+	}
+}
+
+func cmdPop(cmd *cli.Cmd) {
+	cmd.Spec = "[OPTIONS] QUEUE"
+	newClient := clientOpts(cmd)
+	wait := cmd.StringOpt("w wait", "", "Wait for a message up to the duration")
+	name := cmd.StringArg("QUEUE", "", "Queue name")
+	cmd.Action = func() {
+		var d time.Duration
+		if *wait != "" {
+			var err error
+			if d, err = time.ParseDuration(*wait); err != nil {
+				log.Fatal(err)
+			}
+		}
+		e, err := newClient().Pop(*name, d)
+		if err == client.ErrEmpty {
+			cli.Exit(exitEmpty)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "message-id: %s\n", e.ID)
+		for _, m := range e.Messages {
+			os.Stdout.Write(m.Body)
+			if e.IsComposite() {
+				os.Stdout.Write([]byte("\n"))
+			}
+		}
+	}
+}
+
+func cmdAck(cmd *cli.Cmd) {
+	cmd.Spec = "[OPTIONS] ID"
+	newClient := clientOpts(cmd)
+	id := cmd.StringArg("ID", "", "Message ID")
+	cmd.Action = func() {
+		if err := newClient().Ack(*id); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func cmdFlush(cmd *cli.Cmd) {
+	cmd.Spec = "[OPTIONS] QUEUE"
+	newClient := clientOpts(cmd)
+	name := cmd.StringArg("QUEUE", "", "Queue name or pattern")
+	cmd.Action = func() {
+		flushed, err := newClient().Flush(*name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(flushed)
+	}
+}
+
+func cmdPropsGet(cmd *cli.Cmd) {
+	cmd.Spec = "[OPTIONS] QUEUE"
+	newClient := clientOpts(cmd)
+	inherit := cmd.BoolOpt("i inherit", false, "Include properties inherited from ancestors")
+	name := cmd.StringArg("QUEUE", "", "Queue name")
+	cmd.Action = func() {
+		props, err := newClient().Properties(*name, *inherit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if props == nil {
+			props = queue.NewProperties()
+		}
+		printJSON(props)
+	}
+}
+
+func cmdPropsSet(cmd *cli.Cmd) {
+	cmd.Spec = "[OPTIONS] QUEUE"
+	cmd.LongDesc = "Set properties of a queue. Properties are taken from the options, or read from stdin as JSON if no option is given."
+	newClient := clientOpts(cmd)
+	popts := newPropertyOpts(cmd)
+	recurse := cmd.StringOpt("recurse", "", "Pop from descendant queues too (true|false)")
+	name := cmd.StringArg("QUEUE", "", "Queue name")
+	cmd.Action = func() {
+		props, err := popts.properties()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *recurse != "" {
+			b, err := strconv.ParseBool(*recurse)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if props == nil {
+				props = queue.NewProperties()
+			}
+			props.SetRecurse(b)
+		}
+		if props == nil {
+			props = queue.NewProperties()
+			if err := json.NewDecoder(os.Stdin).Decode(props); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := newClient().SetProperties(*name, props); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
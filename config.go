@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/webhook"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the content of the configuration file.
+//
+//	listen: [":3900", "unix:/run/pluq.sock"]
+//	storage:
+//	  driver: bolt
+//	  path: /var/lib/pluq/pluq.db
+//	uid:
+//	  machine_id: 1
+//	  salt: secret
+//	properties:
+//	  "":
+//	    retry: 3
+//	  jobs:
+//	    timeout: 1m
+//	    recurse: true
+//	webhooks:
+//	  - url: https://example.com/hooks/pluq
+//	    prefix: jobs
+//	    events: [discarded, acked]
+//	    timeout: 5s
+//	    retry: 3
+type config struct {
+	Listen  []string `yaml:"listen"`
+	Storage struct {
+		Driver string `yaml:"driver"`
+		Path   string `yaml:"path"`
+	} `yaml:"storage"`
+	UID struct {
+		MachineID *int   `yaml:"machine_id"`
+		Salt      string `yaml:"salt"`
+	} `yaml:"uid"`
+	Properties map[string]*yamlProperties `yaml:"properties"`
+	Webhooks   []*yamlWebhook             `yaml:"webhooks"`
+}
+
+type yamlWebhook struct {
+	URL     string   `yaml:"url"`
+	Prefix  string   `yaml:"prefix"`
+	Events  []string `yaml:"events"`
+	Timeout string   `yaml:"timeout"`
+	Retry   *int     `yaml:"retry"`
+}
+
+// defaultWebhookRetry is the number of retries of a webhook without retry.
+const defaultWebhookRetry = 3
+
+func (c *config) webhooks() ([]*webhook.Hook, error) {
+	var hooks []*webhook.Hook
+	for _, v := range c.Webhooks {
+		h := &webhook.Hook{
+			URL:    v.URL,
+			Prefix: v.Prefix,
+			Events: v.Events,
+			Retry:  defaultWebhookRetry,
+		}
+		if v.Timeout != "" {
+			d, err := time.ParseDuration(v.Timeout)
+			if err != nil {
+				return nil, err
+			}
+			h.Timeout = d
+		}
+		if v.Retry != nil {
+			h.Retry = *v.Retry
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// yamlProperties decodes queue properties with the same rules as the
+// properties API by converting YAML into JSON.
+type yamlProperties struct {
+	queue.Properties
+}
+
+func (p *yamlProperties) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	b, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &p.Properties)
+}
+
+// jsonValue converts maps decoded by yaml into ones encodable by json.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = jsonValue(x)
+		}
+		return m
+	case []interface{}:
+		for i, x := range v {
+			v[i] = jsonValue(x)
+		}
+	}
+	return v
+}
+
+// applyProperties sets the property tree of the config to the manager.
+// Properties of the paths in prev that are no longer configured are
+// removed. They are not persisted since the config is the source of them. It
+// returns the configured paths.
+func (c *config) applyProperties(m *queue.Manager, prev []string) []string {
+	configured := make(map[string]bool)
+	var paths []string
+	for path, props := range c.Properties {
+		path = strings.Trim(path, "/")
+		p := queue.NewProperties()
+		if props != nil {
+			*p = props.Properties
+		}
+		if err := m.ConfigureProperties(path, p); err != nil {
+			log.Printf("Failed to set properties of %q: %v", path, err)
+		}
+		configured[path] = true
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range prev {
+		if !configured[path] {
+			if err := m.ConfigureProperties(path, nil); err != nil {
+				log.Printf("Failed to remove properties of %q: %v", path, err)
+			}
+		}
+	}
+	return paths
+}
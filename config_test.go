@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/storage/bolt"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+listen: [":3901"]
+storage:
+  driver: memory
+uid:
+  machine_id: 3
+properties:
+  "":
+    retry: 3
+  jobs/:
+    timeout: 1m
+    recurse: true
+    rate_limit: {limit: 10, interval: 1s}
+webhooks:
+  - url: http://localhost/hook
+    events: [discarded]
+    timeout: 2s
+`)
+	f.Close()
+
+	c, err := loadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Storage.Driver != "memory" || *c.UID.MachineID != 3 || c.Listen[0] != ":3901" {
+		t.Errorf("unexpected config: %+v", c)
+	}
+	props := c.Properties["jobs/"]
+	if *props.Timeout != types.Duration(time.Minute) || !*props.Recurse || props.RateLimit.Limit != 10 {
+		t.Errorf("unexpected properties: %+v", props)
+	}
+	if *c.Properties[""].Retry != 3 {
+		t.Errorf("retry = %v, want 3", *c.Properties[""].Retry)
+	}
+	hooks, err := c.webhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 || hooks[0].Timeout != 2*time.Second || hooks[0].Retry != defaultWebhookRetry {
+		t.Errorf("unexpected webhooks: %+v", hooks)
+	}
+}
+
+func TestApplyPropertiesNotPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := bolt.New(filepath.Join(dir, "pluq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	idgen, err := uid.NewGenerator(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := queue.NewManager(idgen, d)
+
+	retry := types.Retry(3)
+	c := &config{Properties: map[string]*yamlProperties{"jobs/": {Properties: queue.Properties{Retry: &retry}}}}
+	prev := c.applyProperties(m, nil)
+	if p := m.Properties("jobs", false); p == nil || *p.Retry != 3 {
+		t.Fatalf("unexpected properties: %+v", p)
+	}
+	stored, err := d.LoadProperties()
+	if err != nil || len(stored) != 0 {
+		t.Fatalf("config properties are stored: %q, %v", stored, err)
+	}
+
+	c.Properties = nil
+	c.applyProperties(m, prev)
+	if p := m.Properties("jobs", false); p != nil {
+		t.Fatalf("properties not removed: %+v", p)
+	}
+}
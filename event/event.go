@@ -1,5 +1,11 @@
 package event
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
 type EventType int
 
 const (
@@ -10,6 +16,21 @@ const (
 	EventMessageAvailable
 )
 
+var eventNames = map[EventType]string{
+	EventMessagePushed:    "pushed",
+	EventMessagePoped:     "popped",
+	EventMessageProceeded: "acked",
+	EventMessageDiscarded: "discarded",
+	EventMessageAvailable: "available",
+}
+
+func (e EventType) String() string {
+	if s, ok := eventNames[e]; ok {
+		return s
+	}
+	return "unknown"
+}
+
 type Handler interface {
 	HandleEvent(EventType, interface{})
 }
@@ -21,35 +42,145 @@ func (f HandlerFunc) HandleEvent(e EventType, v interface{}) {
 }
 
 type event struct {
-	e EventType
-	v interface{}
+	e    EventType
+	v    interface{}
+	done chan struct{}
+}
+
+var ErrDispatcherTimeout = errors.New("Error event dispatcher not responding")
+
+type subscriber struct {
+	h Handler
 }
 
 var (
 	handlers    = make(map[EventType][]Handler)
 	allHandlers []Handler
+	subscribers []*subscriber
+	handlersMu  sync.RWMutex
 	eventc      = make(chan *event, 1000)
+	quit        = make(chan struct{})
+	stopOnce    sync.Once
 )
 
+// Emit queues the event for Dispatch. It blocks while the queue is full, so
+// handlers must use EmitFromHandler instead to avoid deadlocking the
+// dispatcher.
 func Emit(e EventType, v interface{}) {
-	eventc <- &event{e, v}
+	select {
+	case eventc <- &event{e: e, v: v}:
+	case <-quit:
+	}
+}
+
+// EmitFromHandler is Emit for handlers running on the dispatcher. If the
+// queue is full, it calls the handlers directly instead of blocking.
+func EmitFromHandler(e EventType, v interface{}) {
+	select {
+	case eventc <- &event{e: e, v: v}:
+	default:
+		call(e, v)
+	}
+}
+
+// Ping checks that Dispatch is running by passing a marker through the
+// event queue. It fails if the marker is not handled within timeout.
+func Ping(timeout time.Duration) error {
+	ev := &event{done: make(chan struct{})}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case eventc <- ev:
+	case <-quit:
+		return ErrDispatcherTimeout
+	case <-timer.C:
+		return ErrDispatcherTimeout
+	}
+	select {
+	case <-ev.done:
+		return nil
+	case <-timer.C:
+		return ErrDispatcherTimeout
+	}
 }
 
 func Handle(e EventType, h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
 	handlers[e] = append(handlers[e], h)
 }
 
 func HandleAll(h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
 	allHandlers = append(allHandlers, h)
 }
 
-func Dispatch() {
-	for ev := range eventc {
-		for _, h := range allHandlers {
-			h.HandleEvent(ev.e, ev.v)
+// Subscribe is like HandleAll but can be called while Dispatch is running.
+// The returned function removes the handler. The handler may still be
+// called once by an event being dispatched at that time.
+func Subscribe(h Handler) (unsubscribe func()) {
+	s := &subscriber{h: h}
+	handlersMu.Lock()
+	subscribers = append(subscribers, s)
+	handlersMu.Unlock()
+	return func() {
+		handlersMu.Lock()
+		defer handlersMu.Unlock()
+		for i, v := range subscribers {
+			if v == s {
+				subscribers = append(subscribers[:i], subscribers[i+1:]...)
+				return
+			}
 		}
-		for _, h := range handlers[ev.e] {
-			h.HandleEvent(ev.e, ev.v)
+	}
+}
+
+// Handled reports whether the event has any handler. Emitters of frequent
+// events check it to avoid building and queueing events nobody receives.
+func Handled(e EventType) bool {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	return len(allHandlers) > 0 || len(subscribers) > 0 || len(handlers[e]) > 0
+}
+
+// handlersFor returns the handlers of the event.
+func handlersFor(e EventType) []Handler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	hs := make([]Handler, 0, len(allHandlers)+len(subscribers)+len(handlers[e]))
+	hs = append(hs, allHandlers...)
+	for _, s := range subscribers {
+		hs = append(hs, s.h)
+	}
+	return append(hs, handlers[e]...)
+}
+
+func Dispatch() {
+	for {
+		select {
+		case ev := <-eventc:
+			if ev.done != nil {
+				close(ev.done)
+				continue
+			}
+			call(ev.e, ev.v)
+		case <-quit:
+			return
 		}
 	}
 }
+
+// call calls the handlers of the event in the current goroutine.
+func call(e EventType, v interface{}) {
+	for _, h := range handlersFor(e) {
+		h.HandleEvent(e, v)
+	}
+}
+
+// Stop makes Dispatch return. Events emitted after that are dropped.
+func Stop() {
+	stopOnce.Do(func() {
+		close(quit)
+	})
+}
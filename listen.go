@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// listen opens a listener for each address. An address is either a TCP
+// address served as plain HTTP, a TCP address prefixed with https:// served
+// over TLS, or a socket path prefixed with unix:.
+func listen(addrs []string, config *tls.Config) ([]net.Listener, error) {
+	var ls []net.Listener
+	for _, addr := range addrs {
+		l, err := listenAddr(addr, config)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func listenAddr(addr string, config *tls.Config) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			// Remove a stale socket left by the previous process
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	case strings.HasPrefix(addr, "https://"):
+		if config == nil {
+			return nil, fmt.Errorf("%s: certificate and key are required", addr)
+		}
+		l, err := net.Listen("tcp", strings.TrimPrefix(addr, "https://"))
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, config), nil
+	}
+	return net.Listen("tcp", strings.TrimPrefix(addr, "http://"))
+}
+
+// newTLSConfig returns a TLS configuration from the certificate and key. If
+// clientCA is given, clients are required to present a certificate signed by
+// it.
+func newTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if cert == "" && key == "" {
+		if clientCA != "" {
+			return nil, errors.New("client CA requires certificate and key")
+		}
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if clientCA != "" {
+		b, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serve serves HTTP requests on all listeners. Errors other than the one
+// caused by shutdown are sent to the returned channel.
+func serve(ls []net.Listener, h http.Handler) ([]*http.Server, <-chan error) {
+	errc := make(chan error, len(ls))
+	var srvs []*http.Server
+	for _, l := range ls {
+		srv := &http.Server{Handler: h}
+		srvs = append(srvs, srv)
+		go func(l net.Listener) {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}(l)
+	}
+	return srvs, errc
+}
+
+// shutdown stops the servers from accepting new connections and waits for
+// active requests to finish up to timeout.
+func shutdown(srvs []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errc := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func(srv *http.Server) {
+			errc <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range srvs {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -3,53 +3,219 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jawher/mow.cli"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yosisa/pluq/auth"
 	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/metrics"
 	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/schedule"
 	"github.com/yosisa/pluq/server"
 	"github.com/yosisa/pluq/storage"
 	"github.com/yosisa/pluq/storage/bolt"
 	"github.com/yosisa/pluq/storage/memory"
 	"github.com/yosisa/pluq/uid"
+	"github.com/yosisa/pluq/webhook"
 	"golang.org/x/net/context"
 )
 
-func newStorageDriver(s string) (storage.Driver, error) {
+func newStorageDriver(s, path string) (storage.Driver, error) {
 	switch s {
 	case "memory":
 		return memory.New(), nil
 	case "bolt":
-		return bolt.New("pluq.db")
+		if path == "" {
+			path = "pluq.db"
+		}
+		return bolt.New(path)
 	}
 	return nil, fmt.Errorf("Unsupported storage driver: %s", s)
 }
 
+func middlewares(requestIDHeader, accessLog string, recoverPanic bool) ([]server.Middleware, error) {
+	var ms []server.Middleware
+	if requestIDHeader != "" {
+		ms = append(ms, server.RequestID(requestIDHeader))
+	}
+	switch accessLog {
+	case "":
+	case "-":
+		ms = append(ms, server.AccessLog(os.Stderr))
+	default:
+		f, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, server.AccessLog(f))
+	}
+	if recoverPanic {
+		ms = append(ms, server.Recover())
+	}
+	return ms, nil
+}
+
 func main() {
 	app := cli.App("pluq", "A pluggable message queue")
-	storageDriver := app.StringOpt("storage-driver", "bolt", "Change the storage driver (bolt|memory)")
-	listen := app.StringOpt("l listen", ":3900", "Listen address")
+	configFile := app.StringOpt("c config", "", "Load the YAML config file, reloaded on SIGHUP")
+	var storageDriverSet, listensSet bool
+	storageDriver := app.String(cli.StringOpt{
+		Name:      "storage-driver",
+		Value:     "bolt",
+		Desc:      "Change the storage driver (bolt|memory)",
+		SetByUser: &storageDriverSet,
+	})
+	listens := app.Strings(cli.StringsOpt{
+		Name:      "l listen",
+		Value:     []string{":3900"},
+		Desc:      "Listen address (host:port, https://host:port or unix:path), can be repeated",
+		SetByUser: &listensSet,
+	})
+	tlsCert := app.StringOpt("tls-cert", "", "Certificate file for https listeners")
+	tlsKey := app.StringOpt("tls-key", "", "Private key file for https listeners")
+	tlsClientCA := app.StringOpt("tls-client-ca", "", "Require client certificates signed by the CA file")
+	authFile := app.StringOpt("auth-file", "", "Enable authentication with the token file")
+	metricsLabelDepth := app.IntOpt("metrics-label-depth", 0, "Number of queue path components used as metric labels (0 means all)")
+	accessLog := app.StringOpt("access-log", "", "Write JSON access logs to the file (- for stderr)")
+	requestIDHeader := app.StringOpt("request-id-header", "X-Request-Id", "Header to echo request IDs in (empty to disable)")
+	recoverPanic := app.BoolOpt("recover", true, "Respond 500 instead of dropping the connection on panic")
+	shutdownTimeout := app.StringOpt("shutdown-timeout", "30s", "Time to wait for active requests on shutdown")
 	app.Action = func() {
-		idgen, err := uid.NewGenerator(0)
+		conf := &config{}
+		if *configFile != "" {
+			var err error
+			if conf, err = loadConfig(*configFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Flags given explicitly take precedence over the config file
+		if !storageDriverSet && conf.Storage.Driver != "" {
+			*storageDriver = conf.Storage.Driver
+		}
+		if !listensSet && len(conf.Listen) > 0 {
+			*listens = conf.Listen
+		}
+
+		var machineID int
+		if conf.UID.MachineID != nil {
+			machineID = *conf.UID.MachineID
+		}
+		if conf.UID.Salt != "" {
+			uid.SetSalt(conf.UID.Salt)
+		}
+		idgen, err := uid.NewGenerator(machineID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d, err := newStorageDriver(*storageDriver, conf.Storage.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		metrics.LabelDepth = *metricsLabelDepth
+		m := queue.NewManager(idgen, d)
+		prometheus.MustRegister(metrics.NewCollector(m))
+		configured := conf.applyProperties(m, nil)
+
+		sched, err := schedule.New(m, d)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		d, err := newStorageDriver(*storageDriver)
+		hooks, err := conf.webhooks()
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer d.Close()
+		notifier, err := webhook.New(hooks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifier.Register()
 
 		ctx := context.Background()
-		ctx = queue.NewContext(ctx, queue.NewManager(idgen, d))
+		ctx = queue.NewContext(ctx, m)
+		ctx = schedule.NewContext(ctx, sched)
+		if *authFile != "" {
+			store, err := auth.Load(*authFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ctx = auth.NewContext(ctx, store)
+		}
 
-		go event.Dispatch()
-		if err := http.ListenAndServe(*listen, server.New(ctx)); err != nil {
+		tlsConfig, err := newTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
 			log.Fatal(err)
 		}
+		ls, err := listen(*listens, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ms, err := middlewares(*requestIDHeader, *accessLog, *recoverPanic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		timeout, err := time.ParseDuration(*shutdownTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go event.Dispatch()
+		srvs, errc := serve(ls, server.New(ctx, ms...))
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		exitCode := 0
+	Loop:
+		for {
+			select {
+			case err := <-errc:
+				log.Print(err)
+				exitCode = 1
+				break Loop
+			case sig := <-sigc:
+				if sig != syscall.SIGHUP {
+					log.Printf("Received %s, shutting down", sig)
+					break Loop
+				}
+				if *configFile == "" {
+					continue
+				}
+				// Only the property tree is reloaded, other settings
+				// require a restart.
+				conf, err := loadConfig(*configFile)
+				if err != nil {
+					log.Printf("Failed to reload config: %v", err)
+					continue
+				}
+				configured = conf.applyProperties(m, configured)
+				log.Printf("Reloaded properties from %s", *configFile)
+			}
+		}
+
+		// Fail readiness checks, then complete waiting pops so that active
+		// requests finish before the servers shut down.
+		server.SetDraining(true)
+		sched.Stop()
+		m.Shutdown()
+		if err := shutdown(srvs, timeout); err != nil {
+			log.Print(err)
+			exitCode = 1
+		}
+		event.Stop()
+		notifier.Close()
+		if err := d.Close(); err != nil {
+			log.Print(err)
+			exitCode = 1
+		}
+		os.Exit(exitCode)
 	}
+	clientCommands(app)
 	app.Run(os.Args)
 }
@@ -0,0 +1,131 @@
+// Package metrics provides Prometheus metrics of queues.
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yosisa/pluq/storage"
+)
+
+const namespace = "pluq"
+
+// LabelDepth limits the number of path components of a queue name used as
+// the queue label to bound the cardinality. Zero means no limit.
+var LabelDepth = 0
+
+var (
+	Pushes   = newCounter("messages_pushed_total", "Number of pushed messages.")
+	Pops     = newCounter("envelopes_popped_total", "Number of delivered envelopes.")
+	Acks     = newCounter("envelopes_acked_total", "Number of acknowledged envelopes.")
+	Resets   = newCounter("envelopes_reset_total", "Number of envelopes returned to the queue.")
+	Discards = newCounter("envelopes_discarded_total", "Number of envelopes discarded due to retry exhaustion.")
+
+	TimeInQueue = newHistogram("time_in_queue_seconds",
+		"Time from enqueue to delivery of envelopes.")
+	ProcessingLatency = newHistogram("processing_latency_seconds",
+		"Time from enqueue to acknowledgement of envelopes.")
+)
+
+func newCounter(name, help string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, []string{"queue"})
+}
+
+func newHistogram(name, help string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+	}, []string{"queue"})
+}
+
+// Label returns the queue label of the queue name.
+func Label(queue string) string {
+	if LabelDepth <= 0 {
+		return queue
+	}
+	keys := strings.SplitN(queue, "/", LabelDepth+1)
+	if len(keys) > LabelDepth {
+		keys = keys[:LabelDepth]
+	}
+	return strings.Join(keys, "/")
+}
+
+// Inc increments the counter of the queue.
+func Inc(c *prometheus.CounterVec, queue string) {
+	c.WithLabelValues(Label(queue)).Inc()
+}
+
+// ObserveSince records the time elapsed since t in the histogram. Zero t is
+// ignored.
+func ObserveSince(h *prometheus.HistogramVec, queue string, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	h.WithLabelValues(Label(queue)).Observe(time.Since(t).Seconds())
+}
+
+// Source provides the current state of queues.
+type Source interface {
+	Stats() (map[string]*storage.QueueStats, error)
+	Waiters() int
+}
+
+var (
+	depthDesc = prometheus.NewDesc(namespace+"_queue_depth",
+		"Number of messages waiting for delivery.", []string{"queue"}, nil)
+	inFlightDesc = prometheus.NewDesc(namespace+"_queue_in_flight",
+		"Number of envelopes delivered but not acknowledged.", []string{"queue"}, nil)
+	waitersDesc = prometheus.NewDesc(namespace+"_long_poll_waiters",
+		"Number of long-poll requests waiting for a message.", nil, nil)
+)
+
+type collector struct {
+	src Source
+}
+
+// NewCollector returns a collector which reports gauges of the source on
+// each scrape.
+func NewCollector(src Source) prometheus.Collector {
+	return &collector{src: src}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- depthDesc
+	ch <- inFlightDesc
+	ch <- waitersDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(waitersDesc, prometheus.GaugeValue, float64(c.src.Waiters()))
+	stats, err := c.src.Stats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(depthDesc, err)
+		return
+	}
+	merged := make(map[string]*storage.QueueStats)
+	for name, s := range stats {
+		label := Label(name)
+		m := merged[label]
+		if m == nil {
+			m = &storage.QueueStats{}
+			merged[label] = m
+		}
+		m.Depth += s.Depth
+		m.InFlight += s.InFlight
+	}
+	for label, s := range merged {
+		ch <- prometheus.MustNewConstMetric(depthDesc, prometheus.GaugeValue, float64(s.Depth), label)
+		ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(s.InFlight), label)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(Pushes, Pops, Acks, Resets, Discards, TimeInQueue, ProcessingLatency)
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import "testing"
+
+func TestLabel(t *testing.T) {
+	defer func(n int) { LabelDepth = n }(LabelDepth)
+	for _, c := range []struct {
+		depth int
+		queue string
+		label string
+	}{
+		{0, "a/b/c", "a/b/c"},
+		{1, "a/b/c", "a"},
+		{2, "a/b/c", "a/b"},
+		{2, "a", "a"},
+		{1, "", ""},
+	} {
+		LabelDepth = c.depth
+		if got := Label(c.queue); got != c.label {
+			t.Errorf("Label(%q) with depth %d = %q, want %q", c.queue, c.depth, got, c.label)
+		}
+	}
+}
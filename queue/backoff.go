@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/yosisa/pluq/types"
+)
+
+var ErrInvalidBackoff = errors.New("Error invalid backoff policy")
+
+// Backoff delays the redelivery of a message whose lease expired or was
+// released. It is supported if the storage driver implements
+// storage.Backoffer. The delay
+// after the n-th delivery is Delay for the constant policy, n*Delay for the
+// linear one and 2^(n-1)*Delay for the exponential one, capped at Max if
+// set. Jitter randomizes the delay between its half and itself.
+type Backoff struct {
+	Policy string         `json:"policy"`
+	Delay  types.Duration `json:"delay"`
+	Max    types.Duration `json:"max,omitempty"`
+	Jitter bool           `json:"jitter,omitempty"`
+}
+
+func (b *Backoff) validate() error {
+	switch b.Policy {
+	case "", "constant", "linear", "exponential":
+	default:
+		return ErrInvalidBackoff
+	}
+	if b.Delay < 0 || b.Max < 0 {
+		return ErrInvalidBackoff
+	}
+	return nil
+}
+
+// delay returns the delay before redelivery after the attempts-th delivery.
+func (b *Backoff) delay(attempts int) time.Duration {
+	d := time.Duration(b.Delay)
+	if d <= 0 || attempts < 1 {
+		return 0
+	}
+	max := time.Duration(b.Max)
+	switch b.Policy {
+	case "linear":
+		if max > 0 && int64(attempts) > int64(max/d) {
+			d = max
+		} else {
+			d *= time.Duration(attempts)
+		}
+	case "exponential":
+		for i := 1; i < attempts && (max <= 0 || d < max) && d <= d<<1; i++ {
+			d <<= 1
+		}
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	if b.Jitter {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
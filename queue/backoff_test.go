@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/yosisa/pluq/types"
+	. "gopkg.in/check.v1"
+)
+
+type BackoffSuite struct{}
+
+var _ = Suite(&BackoffSuite{})
+
+func (s *BackoffSuite) TestDelay(c *C) {
+	sec := types.Duration(time.Second)
+	for _, t := range []struct {
+		b        Backoff
+		attempts int
+		expected time.Duration
+	}{
+		{Backoff{Delay: sec}, 3, time.Second},
+		{Backoff{Policy: "constant", Delay: sec}, 0, 0},
+		{Backoff{Policy: "linear", Delay: sec}, 3, 3 * time.Second},
+		{Backoff{Policy: "linear", Delay: sec, Max: 2 * sec}, 3, 2 * time.Second},
+		{Backoff{Policy: "exponential", Delay: sec}, 1, time.Second},
+		{Backoff{Policy: "exponential", Delay: sec}, 4, 8 * time.Second},
+		{Backoff{Policy: "exponential", Delay: sec, Max: 5 * sec}, 4, 5 * time.Second},
+		{Backoff{Policy: "exponential", Delay: sec, Max: 5 * sec}, 1000, 5 * time.Second},
+	} {
+		c.Assert(t.b.delay(t.attempts), Equals, t.expected, Commentf("%+v", t.b))
+	}
+}
+
+func (s *BackoffSuite) TestJitter(c *C) {
+	b := Backoff{Policy: "exponential", Delay: types.Duration(time.Second), Jitter: true}
+	for i := 0; i < 100; i++ {
+		d := b.delay(2)
+		c.Assert(d >= time.Second && d <= 2*time.Second, Equals, true)
+	}
+}
+
+func (s *BackoffSuite) TestValidate(c *C) {
+	c.Assert((&Backoff{Policy: "exponential"}).validate(), IsNil)
+	c.Assert((&Backoff{Policy: "fibonacci"}).validate(), Equals, ErrInvalidBackoff)
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+)
+
+// fairScheduler orders queues found by a request with smooth weighted
+// round-robin so that each queue gets service in proportion to its weight.
+// The state is kept per request key, typically the requested name. At most
+// maxFairKeys keys are kept and the least recently used one is evicted.
+type fairScheduler struct {
+	credits map[string]*fairState
+	tick    uint64
+	m       sync.Mutex
+}
+
+type fairState struct {
+	credits map[string]int
+	used    uint64
+}
+
+var maxFairKeys = 1024
+
+func newFairScheduler() *fairScheduler {
+	return &fairScheduler{credits: make(map[string]*fairState)}
+}
+
+func weight(q *queue) int {
+	if q.props.Weight == nil || *q.props.Weight < 1 {
+		return 1
+	}
+	return *q.props.Weight
+}
+
+// order returns the queues in the order to try. The queue with the highest
+// credit comes first, ties are broken by name.
+func (s *fairScheduler) order(key string, queues []*queue) []*queue {
+	if len(queues) < 2 {
+		return queues
+	}
+	var credits map[string]int
+	s.m.Lock()
+	if st := s.credits[key]; st != nil {
+		credits = st.credits
+	}
+	s.m.Unlock()
+	out := make([]*queue, len(queues))
+	copy(out, queues)
+	score := func(q *queue) int {
+		return credits[q.name()] + weight(q)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		si, sj := score(out[i]), score(out[j])
+		if si != sj {
+			return si > sj
+		}
+		return out[i].name() < out[j].name()
+	})
+	return out
+}
+
+// delivered updates the credits after a message of name is delivered from
+// the queues returned by order. Queues tried before it were empty and lose
+// their credits so that they do not burst when they get messages.
+func (s *fairScheduler) delivered(key string, queues []*queue, name string) {
+	if len(queues) < 2 {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	var old map[string]int
+	if st := s.credits[key]; st != nil {
+		old = st.credits
+	}
+	credits := make(map[string]int, len(queues))
+	var total int
+	skipped := true
+	for _, q := range queues {
+		n := q.name()
+		if n == name {
+			skipped = false
+		}
+		if skipped {
+			continue
+		}
+		credits[n] = old[n] + weight(q)
+		total += weight(q)
+	}
+	if skipped {
+		return
+	}
+	credits[name] -= total
+	if old == nil && len(s.credits) >= maxFairKeys {
+		s.evict()
+	}
+	s.tick++
+	s.credits[key] = &fairState{credits: credits, used: s.tick}
+}
+
+// evict removes the least recently used key.
+func (s *fairScheduler) evict() {
+	var oldest string
+	var used uint64
+	for key, st := range s.credits {
+		if used == 0 || st.used < used {
+			oldest, used = key, st.used
+		}
+	}
+	delete(s.credits, oldest)
+}
@@ -0,0 +1,67 @@
+package queue
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type FairSuite struct{}
+
+var _ = Suite(&FairSuite{})
+
+func (s *FairSuite) TestWeightedRoundRobin(c *C) {
+	root := newNode()
+	root.setProperties([]string{"t"}, NewProperties().SetRecurse(true))
+	root.setProperties([]string{"t", "a"}, NewProperties().SetWeight(3))
+	root.lookup([]string{"t", "b"})
+
+	f := newFairScheduler()
+	counts := make(map[string]int)
+	var seq []string
+	for i := 0; i < 8; i++ {
+		queues := f.order("t", root.findQueue([]string{"t"}))
+		// t itself is always empty
+		name := queues[0].name()
+		if name == "t" {
+			name = queues[1].name()
+		}
+		f.delivered("t", queues, name)
+		counts[name]++
+		seq = append(seq, name)
+	}
+	c.Assert(counts["t/a"], Equals, 6)
+	c.Assert(counts["t/b"], Equals, 2)
+	c.Assert(seq[:4], DeepEquals, []string{"t/a", "t/b", "t/a", "t/a"})
+}
+
+func (s *FairSuite) TestRoundRobin(c *C) {
+	root := newNode()
+	root.setProperties([]string{"t"}, NewProperties().SetRecurse(true))
+	for _, name := range []string{"a", "b", "c"} {
+		root.lookup([]string{"t", name})
+	}
+	f := newFairScheduler()
+	var seq []string
+	for i := 0; i < 6; i++ {
+		queues := f.order("t/*", root.findQueue([]string{"t", "*"}))
+		f.delivered("t/*", queues, queues[0].name())
+		seq = append(seq, queues[0].name())
+	}
+	c.Assert(seq, DeepEquals, []string{"t/a", "t/b", "t/c", "t/a", "t/b", "t/c"})
+}
+
+func (s *FairSuite) TestEvict(c *C) {
+	defer func(n int) { maxFairKeys = n }(maxFairKeys)
+	maxFairKeys = 2
+	root := newNode()
+	root.setProperties([]string{"t"}, NewProperties().SetRecurse(true))
+	root.lookup([]string{"t", "a"})
+	queues := root.findQueue([]string{"t"})
+
+	f := newFairScheduler()
+	for _, key := range []string{"x", "y", "x", "z"} {
+		f.delivered(key, queues, "t/a")
+	}
+	c.Assert(f.credits, HasLen, 2)
+	c.Assert(f.credits["x"], NotNil)
+	c.Assert(f.credits["z"], NotNil)
+}
@@ -1,6 +1,8 @@
 package queue
 
 import (
+	"path"
+	"sort"
 	"strings"
 	"sync"
 
@@ -8,10 +10,19 @@ import (
 )
 
 type Properties struct {
-	Retry     *types.Retry    `json:"retry,omitempty"`
-	Timeout   *types.Duration `json:"timeout,omitempty"`
-	AccumTime *types.Duration `json:"accum_time,omitempty"`
-	Recurse   *bool           `json:"recurse,omitempty"`
+	Retry            *types.Retry    `json:"retry,omitempty"`
+	Timeout          *types.Duration `json:"timeout,omitempty"`
+	Backoff          *Backoff        `json:"backoff,omitempty"`
+	AccumTime        *types.Duration `json:"accum_time,omitempty"`
+	AccumMode        *string         `json:"accum_mode,omitempty"`
+	AccumMaxWait     *types.Duration `json:"accum_max_wait,omitempty"`
+	AccumMaxMessages *int            `json:"accum_max_messages,omitempty"`
+	AccumMaxBytes    *int            `json:"accum_max_bytes,omitempty"`
+	AccumCoalesce    *bool           `json:"accum_coalesce,omitempty"`
+	Recurse          *bool           `json:"recurse,omitempty"`
+	RateLimit        *RateLimit      `json:"rate_limit,omitempty"`
+	EnqueueRateLimit *RateLimit      `json:"enqueue_rate_limit,omitempty"`
+	Weight           *int            `json:"weight,omitempty"`
 }
 
 func NewProperties() *Properties {
@@ -28,16 +39,61 @@ func (p *Properties) SetTimeout(d types.Duration) *Properties {
 	return p
 }
 
+func (p *Properties) SetBackoff(b Backoff) *Properties {
+	p.Backoff = &b
+	return p
+}
+
 func (p *Properties) SetAccumTime(d types.Duration) *Properties {
 	p.AccumTime = &d
 	return p
 }
 
+func (p *Properties) SetAccumMode(s string) *Properties {
+	p.AccumMode = &s
+	return p
+}
+
+func (p *Properties) SetAccumMaxWait(d types.Duration) *Properties {
+	p.AccumMaxWait = &d
+	return p
+}
+
+func (p *Properties) SetAccumMaxMessages(n int) *Properties {
+	p.AccumMaxMessages = &n
+	return p
+}
+
+func (p *Properties) SetAccumMaxBytes(n int) *Properties {
+	p.AccumMaxBytes = &n
+	return p
+}
+
+func (p *Properties) SetAccumCoalesce(b bool) *Properties {
+	p.AccumCoalesce = &b
+	return p
+}
+
 func (p *Properties) SetRecurse(b bool) *Properties {
 	p.Recurse = &b
 	return p
 }
 
+func (p *Properties) SetRateLimit(l RateLimit) *Properties {
+	p.RateLimit = &l
+	return p
+}
+
+func (p *Properties) SetEnqueueRateLimit(l RateLimit) *Properties {
+	p.EnqueueRateLimit = &l
+	return p
+}
+
+func (p *Properties) SetWeight(n int) *Properties {
+	p.Weight = &n
+	return p
+}
+
 func (p *Properties) merge(other *Properties) {
 	if other == nil {
 		return
@@ -48,12 +104,39 @@ func (p *Properties) merge(other *Properties) {
 	if other.Timeout != nil {
 		p.SetTimeout(*other.Timeout)
 	}
+	if other.Backoff != nil {
+		p.SetBackoff(*other.Backoff)
+	}
 	if other.AccumTime != nil {
 		p.SetAccumTime(*other.AccumTime)
 	}
+	if other.AccumMode != nil {
+		p.SetAccumMode(*other.AccumMode)
+	}
+	if other.AccumMaxWait != nil {
+		p.SetAccumMaxWait(*other.AccumMaxWait)
+	}
+	if other.AccumMaxMessages != nil {
+		p.SetAccumMaxMessages(*other.AccumMaxMessages)
+	}
+	if other.AccumMaxBytes != nil {
+		p.SetAccumMaxBytes(*other.AccumMaxBytes)
+	}
+	if other.AccumCoalesce != nil {
+		p.SetAccumCoalesce(*other.AccumCoalesce)
+	}
 	if other.Recurse != nil {
 		p.SetRecurse(*other.Recurse)
 	}
+	if other.RateLimit != nil {
+		p.SetRateLimit(*other.RateLimit)
+	}
+	if other.EnqueueRateLimit != nil {
+		p.SetEnqueueRateLimit(*other.EnqueueRateLimit)
+	}
+	if other.Weight != nil {
+		p.SetWeight(*other.Weight)
+	}
 }
 
 type node struct {
@@ -89,6 +172,22 @@ func (n *node) setProperties(keys []string, props *Properties) {
 	n.children.get(keys[0]).setProperties(keys[1:], props)
 }
 
+// declaredBy returns the name of the deepest node on the keys whose own
+// properties satisfy f, or the name of the keys if there is none.
+func (n *node) declaredBy(keys []string, f func(*Properties) bool) string {
+	depth := len(keys)
+	for i, cur := 0, n; ; i++ {
+		if cur.props != nil && f(cur.props) {
+			depth = i
+		}
+		if i == len(keys) {
+			break
+		}
+		cur = cur.children.get(keys[i])
+	}
+	return strings.Join(keys[:depth], "/")
+}
+
 func (n *node) lookup(keys []string) *node {
 	if len(keys) == 0 {
 		return n
@@ -97,24 +196,88 @@ func (n *node) lookup(keys []string) *node {
 }
 
 func (n *node) findQueue(keys []string) []*queue {
+	if isPattern(keys) {
+		return uniqueQueues(n.findPattern(nil, keys, Properties{}))
+	}
 	props := NewProperties()
 	node := n.mergeProperties(keys, props)
 	return node.findQueueRecurse(keys, *props)
 }
 
+// findQueues finds queues of each keys in order without duplicates.
+func (n *node) findQueues(keysList [][]string) []*queue {
+	if len(keysList) == 1 {
+		return n.findQueue(keysList[0])
+	}
+	var queues []*queue
+	for _, keys := range keysList {
+		queues = append(queues, n.findQueue(keys)...)
+	}
+	return uniqueQueues(queues)
+}
+
+// findPattern finds queues whose names match the pattern. A segment of the
+// pattern is either a glob matched against a single path component or **
+// which matches zero or more components. Only existing nodes are matched.
+func (n *node) findPattern(keys, pattern []string, props Properties) []*queue {
+	if len(pattern) == 0 {
+		return n.findQueueRecurse(keys, props)
+	}
+	var targets []*queue
+	if pattern[0] == "**" {
+		targets = n.findPattern(keys, pattern[1:], props)
+	}
+	props.merge(n.props)
+	n.children.RLock()
+	defer n.children.RUnlock()
+	for name, child := range n.children.m {
+		rest := pattern[1:]
+		if pattern[0] == "**" {
+			rest = pattern
+		} else if ok, _ := path.Match(pattern[0], name); !ok {
+			continue
+		}
+		childKeys := make([]string, len(keys)+1)
+		copy(childKeys, keys)
+		childKeys[len(keys)] = name
+		targets = append(targets, child.findPattern(childKeys, rest, props)...)
+	}
+	return targets
+}
+
+// isPattern reports whether any of the keys is a glob.
+func isPattern(keys []string) bool {
+	for _, k := range keys {
+		if strings.ContainsAny(k, "*?[") {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueQueues(queues []*queue) []*queue {
+	seen := make(map[string]bool)
+	out := queues[:0]
+	for _, q := range queues {
+		if name := q.name(); !seen[name] {
+			seen[name] = true
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
 func (n *node) findQueueRecurse(keys []string, props Properties) []*queue {
 	props.merge(n.props)
 	targets := []*queue{{keys: keys, props: &props}}
 	if props.Recurse == nil || !*props.Recurse {
 		return targets
 	}
-	n.children.RLock()
-	defer n.children.RUnlock()
-	for name, child := range n.children.m {
+	for _, name := range n.children.names() {
 		childKeys := make([]string, len(keys)+1)
 		copy(childKeys, keys)
 		childKeys[len(keys)] = name
-		targets = append(targets, child.findQueueRecurse(childKeys, props)...)
+		targets = append(targets, n.children.get(name).findQueueRecurse(childKeys, props)...)
 	}
 	return targets
 }
@@ -143,6 +306,18 @@ func (m *nodeMap) get(name string) *node {
 	return n
 }
 
+// names returns the sorted names of the children.
+func (m *nodeMap) names() []string {
+	m.RLock()
+	defer m.RUnlock()
+	names := make([]string, 0, len(m.m))
+	for name := range m.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type queue struct {
 	keys  []string
 	props *Properties
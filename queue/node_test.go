@@ -98,6 +98,34 @@ func (s *NodeSuite) TestFindQueue(c *C) {
 	c.Assert(q[2].props, DeepEquals, NewProperties().SetRecurse(true))
 }
 
+func (s *NodeSuite) TestFindPattern(c *C) {
+	root := newNode()
+	for _, name := range []string{"t/a/emails", "t/b/emails", "t/b/sms", "o/1", "o/1/x"} {
+		root.lookup(split(name))
+	}
+	root.setProperties([]string{"t"}, NewProperties().SetRetry(2))
+	names := func(qs []*queue) []string {
+		sort.Sort(ByName(qs))
+		var out []string
+		for _, q := range qs {
+			out = append(out, q.name())
+		}
+		return out
+	}
+
+	q := root.findQueue(split("t/*/emails"))
+	c.Assert(names(q), DeepEquals, []string{"t/a/emails", "t/b/emails"})
+	c.Assert(q[0].props, DeepEquals, NewProperties().SetRetry(2))
+
+	q = root.findQueue(split("o/**"))
+	c.Assert(names(q), DeepEquals, []string{"o", "o/1", "o/1/x"})
+
+	q = root.findQueue(split("**/sms"))
+	c.Assert(names(q), DeepEquals, []string{"t/b/sms"})
+
+	c.Assert(root.findQueue(split("x/*")), HasLen, 0)
+}
+
 type ByName []*queue
 
 func (p ByName) Len() int { return len(p) }
@@ -1,11 +1,16 @@
 package queue
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
 	"strings"
 	"time"
 
 	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/metrics"
 	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
 	"github.com/yosisa/pluq/uid"
 )
 
@@ -42,21 +47,35 @@ func (d *mdDriver) DequeueAny(names []string, eid uid.ID) (e *storage.Envelope,
 	return nil, storage.ErrEmpty
 }
 
+// ErrInvalidName is returned when a pattern is used where a queue name is
+// required.
+var ErrInvalidName = errors.New("Error patterns are only allowed to pop")
+
+// ErrNotSupported is returned when the storage driver lacks the feature.
+var ErrNotSupported = errors.New("Error not supported by the storage driver")
+
 type Manager struct {
-	idg   *uid.Generator
-	sd    storage.Driver
-	sme   storage.MultiEnqueuer
-	smd   storage.MultiDequeuer
-	root  *node
-	waits *waiters
+	idg           *uid.Generator
+	sd            storage.Driver
+	sme           storage.MultiEnqueuer
+	smd           storage.MultiDequeuer
+	root          *node
+	waits         *waiters
+	enqueueLimits *rateLimiters
+	dequeueLimits *rateLimiters
+	fair          *fairScheduler
+	subs          subscriptions
 }
 
 func NewManager(idg *uid.Generator, sd storage.Driver) *Manager {
 	m := &Manager{
-		idg:   idg,
-		sd:    sd,
-		root:  newNode(),
-		waits: &waiters{},
+		idg:           idg,
+		sd:            sd,
+		root:          newNode(),
+		waits:         &waiters{},
+		enqueueLimits: newRateLimiters(),
+		dequeueLimits: newRateLimiters(),
+		fair:          newFairScheduler(),
 	}
 	if sme, ok := sd.(storage.MultiEnqueuer); ok {
 		m.sme = sme
@@ -68,38 +87,80 @@ func NewManager(idg *uid.Generator, sd storage.Driver) *Manager {
 	} else {
 		m.smd = &mdDriver{sd}
 	}
+	if b, ok := sd.(storage.Backoffer); ok {
+		b.SetBackoff(m.backoffDelay)
+	}
+	if err := m.loadProperties(); err != nil {
+		log.Printf("Failed to load properties: %v", err)
+	}
+	if err := m.loadQueues(); err != nil {
+		log.Printf("Failed to load queues: %v", err)
+	}
 	event.Handle(event.EventMessageAvailable, m)
+	event.Handle(event.EventMessageDiscarded, m)
 	return m
 }
 
-func (q *Manager) Enqueue(name string, msg *storage.Message, p *Properties) (map[string]*storage.EnqueueMeta, error) {
+// Enqueue pushes the message to the queue and the queues found by recursion.
+// Messages with the same accumKey are accumulated into one envelope when
+// accumulation is enabled.
+func (q *Manager) Enqueue(name string, msg *storage.Message, p *Properties, accumKey string) (map[string]*storage.EnqueueMeta, error) {
+	if isPattern(split(name)) {
+		return nil, ErrInvalidName
+	}
 	queues := q.root.findQueue(split(name))
+	if err := q.admitEnqueue(queues); err != nil {
+		return nil, err
+	}
+	pushed := event.Handled(event.EventMessagePushed)
 	if len(queues) == 1 {
-		e, es, err := q.prepareEnqueue(queues[0], msg, p)
+		e, es, err := q.prepareEnqueue(queues[0], msg, p, accumKey)
 		if err != nil {
 			return nil, err
 		}
+		// The event copies the envelope before the driver accumulates into it
+		var me *storage.MessageEvent
+		if pushed {
+			me = storage.NewMessageEvent(event.EventMessagePushed, e)
+		}
 		meta, err := q.sd.Enqueue(e.Queue, e.ID, e, es)
 		if err != nil {
 			return nil, err
 		}
+		metrics.Inc(metrics.Pushes, e.Queue)
+		if me != nil {
+			event.Emit(event.EventMessagePushed, me)
+		}
 		return map[string]*storage.EnqueueMeta{e.Queue: meta}, nil
 	}
 
 	var es []*storage.Envelope
 	var eos []*storage.EnqueueOptions
+	var mes []*storage.MessageEvent
 	for _, v := range queues {
-		e, eo, err := q.prepareEnqueue(v, msg, p)
+		e, eo, err := q.prepareEnqueue(v, msg, p, accumKey)
 		if err != nil {
 			return nil, err
 		}
 		es = append(es, e)
 		eos = append(eos, eo)
+		if pushed {
+			mes = append(mes, storage.NewMessageEvent(event.EventMessagePushed, e))
+		}
 	}
-	return q.sme.EnqueueAll(es, eos)
+	metas, err := q.sme.EnqueueAll(es, eos)
+	for i, e := range es {
+		if _, ok := metas[e.Queue]; ok {
+			metrics.Inc(metrics.Pushes, e.Queue)
+			if pushed {
+				event.Emit(event.EventMessagePushed, mes[i])
+			}
+		}
+	}
+	return metas, err
 }
 
-func (q *Manager) prepareEnqueue(v *queue, msg *storage.Message, p *Properties) (*storage.Envelope, *storage.EnqueueOptions, error) {
+func (q *Manager) prepareEnqueue(v *queue, msg *storage.Message, p *Properties, accumKey string) (*storage.Envelope, *storage.EnqueueOptions, error) {
 	id, err := q.idg.Next()
 	if err != nil {
 		return nil, nil, err
@@ -109,28 +170,79 @@ func (q *Manager) prepareEnqueue(v *queue, msg *storage.Message, p *Properties)
 	if v.props.AccumTime != nil {
 		opts.AccumTime = *v.props.AccumTime
 	}
+	if v.props.AccumMode != nil {
+		if opts.AccumMode, err = storage.ParseAccumMode(*v.props.AccumMode); err != nil {
+			return nil, nil, err
+		}
+	}
+	if v.props.AccumMaxWait != nil {
+		opts.AccumMaxWait = *v.props.AccumMaxWait
+	}
+	if v.props.AccumMaxMessages != nil {
+		opts.AccumMaxMessages = *v.props.AccumMaxMessages
+	}
+	if v.props.AccumMaxBytes != nil {
+		opts.AccumMaxBytes = *v.props.AccumMaxBytes
+	}
+	if v.props.AccumCoalesce != nil {
+		opts.AccumCoalesce = *v.props.AccumCoalesce
+	}
 	name := v.name()
 	e := newEnvelope(name, v.props, msg)
 	e.ID = id
+	e.MessageID = id
 	e.Queue = name
+	if opts.AccumTime > 0 {
+		opts.AccumKey = accumKey
+		e.AccumKey = accumKey
+	}
 	return e, &opts, nil
 }
 
-func (q *Manager) Dequeue(name string, wait time.Duration, cancel <-chan struct{}) (e *storage.Envelope, err error) {
+func (q *Manager) Dequeue(name string, wait time.Duration, cancel <-chan struct{}) (*storage.Envelope, error) {
+	return q.DequeueAny([]string{name}, wait, cancel)
+}
+
+// DequeueAny dequeues from the first queue having a message in the order of
+// names. Each name may be a pattern. A long-poll wakes when any of the
+// queues gets a message.
+func (q *Manager) DequeueAny(names []string, wait time.Duration, cancel <-chan struct{}) (e *storage.Envelope, err error) {
 	var eid uid.ID
 	if eid, err = q.idg.Next(); err != nil {
 		return
 	}
-	queues := q.root.findQueue(split(name))
-	if len(queues) == 1 {
-		e, err = q.sd.Dequeue(queues[0].name(), eid)
-	} else {
-		var names []string
-		for _, v := range queues {
-			names = append(names, v.name())
+	patterns := make([][]string, len(names))
+	groups := make([][]*queue, len(names))
+	var queues []*queue
+	for i, name := range names {
+		patterns[i] = split(name)
+		groups[i] = q.fair.order(name, q.root.findQueue(patterns[i]))
+		queues = append(queues, groups[i]...)
+	}
+	keys := names
+	names, buckets := q.admitDequeue(uniqueQueues(queues))
+	switch len(names) {
+	case 0:
+		err = storage.ErrEmpty
+	case 1:
+		if e, err = q.sd.Dequeue(names[0], eid); err == nil {
+			e.Queue = names[0]
 		}
+	default:
 		e, err = q.smd.DequeueAny(names, eid)
 	}
+	if err == nil {
+		if b := buckets[e.Queue]; b != nil {
+			b.take()
+		}
+		for i, group := range groups {
+			if containsQueue(group, e.Queue) {
+				q.fair.delivered(keys[i], group, e.Queue)
+				break
+			}
+		}
+		delivered(e, event.Emit)
+	}
 	if err != storage.ErrEmpty || wait == 0 {
 		setEID(e, eid)
 		return
@@ -139,16 +251,196 @@ func (q *Manager) Dequeue(name string, wait time.Duration, cancel <-chan struct{
 	// wait for a new message to be available
 	var ok bool
 	err = nil
-	w := newWaitRequest(q.root, name, wait, cancel)
-	q.waits.add(w)
+	w := newWaitRequest(q.root, patterns, wait, cancel)
+	if !q.waits.add(w) {
+		w.abort()
+		return nil, storage.ErrEmpty
+	}
 	if e, ok = <-w.c; !ok {
 		err = storage.ErrEmpty
 	}
 	return
 }
 
+// admitEnqueue takes a token from the enqueue rate limit of each queue. It
+// returns ErrRateLimited without taking any token if one of them is
+// exceeded.
+func (q *Manager) admitEnqueue(queues []*queue) error {
+	var buckets []*tokenBucket
+	for _, v := range queues {
+		if b := q.enqueueLimits.get(q.root.declaredBy(v.keys, declaresEnqueueRateLimit), v.props.EnqueueRateLimit); b != nil {
+			if ok, _ := b.ready(); !ok {
+				return ErrRateLimited
+			}
+			buckets = append(buckets, b)
+		}
+	}
+	for _, b := range buckets {
+		b.take()
+	}
+	return nil
+}
+
+// admitDequeue returns the names of queues whose dequeue rate limit is not
+// exceeded, and the buckets of the limited ones among them.
+func (q *Manager) admitDequeue(queues []*queue) ([]string, map[string]*tokenBucket) {
+	var names []string
+	var buckets map[string]*tokenBucket
+	for _, v := range queues {
+		name := v.name()
+		if b := q.dequeueLimits.get(q.root.declaredBy(v.keys, declaresRateLimit), v.props.RateLimit); b != nil {
+			if !q.ready(name, b) {
+				continue
+			}
+			if buckets == nil {
+				buckets = make(map[string]*tokenBucket)
+			}
+			buckets[name] = b
+		}
+		names = append(names, name)
+	}
+	return names, buckets
+}
+
+func declaresRateLimit(p *Properties) bool {
+	return p.RateLimit != nil
+}
+
+func declaresEnqueueRateLimit(p *Properties) bool {
+	return p.EnqueueRateLimit != nil
+}
+
+// ready reports whether a message can be dequeued from the queue under the
+// rate limit. If not, waiting requests are notified when a token becomes
+// available.
+func (q *Manager) ready(name string, b *tokenBucket) bool {
+	ok, d := b.ready()
+	if !ok {
+		b.notifyAfter(d, name, func(name string) {
+			event.Emit(event.EventMessageAvailable, name)
+		})
+	}
+	return ok
+}
+
+// Ack removes the dequeued message. Metrics and the event of the ack are
+// recorded if the storage driver can resolve the envelope.
 func (q *Manager) Ack(eid uid.ID) error {
-	return q.sd.Ack(eid)
+	var e *storage.Envelope
+	if r, ok := q.sd.(storage.EnvelopeResolver); ok {
+		var err error
+		if e, err = r.EnvelopeOf(eid); err != nil {
+			return err
+		}
+	}
+	if err := q.sd.Ack(eid); err != nil {
+		return err
+	}
+	if e != nil {
+		metrics.Inc(metrics.Acks, e.Queue)
+		metrics.ObserveSince(metrics.ProcessingLatency, e.Queue, e.EnqueuedAt)
+		emit(event.Emit, event.EventMessageProceeded, e)
+	}
+	return nil
+}
+
+// QueueOf returns the queue of the dequeued message.
+func (q *Manager) QueueOf(eid uid.ID) (string, error) {
+	r, ok := q.sd.(storage.QueueResolver)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return r.QueueOf(eid)
+}
+
+// Extend extends the lease of a dequeued message so that it stays invisible
+// for timeout from now. The backoff delay, if any, follows the lease.
+func (q *Manager) Extend(eid uid.ID, timeout time.Duration) error {
+	ex, ok := q.sd.(storage.Extender)
+	if !ok {
+		return ErrNotSupported
+	}
+	_, err := ex.Extend(eid, types.Duration(timeout))
+	return err
+}
+
+// backoffDelay returns the delay before the message of the dequeued envelope
+// becomes available again by the backoff property of its queue. The storage
+// driver applies it when the lease ends.
+func (q *Manager) backoffDelay(e *storage.Envelope) time.Duration {
+	if !e.Retry.IsValid() {
+		return 0 // no more redelivery
+	}
+	b := q.root.properties(split(e.Queue)).Backoff
+	if b == nil {
+		return 0
+	}
+	return b.delay(e.Attempts)
+}
+
+// Release gives up the lease of a dequeued message and makes it available
+// again after the backoff delay if any. The consumed retry is not restored.
+func (q *Manager) Release(eid uid.ID) error {
+	ex, ok := q.sd.(storage.Extender)
+	if !ok {
+		return ErrNotSupported
+	}
+	e, err := ex.Extend(eid, 0)
+	if err != nil {
+		return err
+	}
+	metrics.Inc(metrics.Resets, e.Queue)
+	return nil
+}
+
+// Stats returns the number of messages per queue if the storage driver
+// supports it.
+func (q *Manager) Stats() (map[string]*storage.QueueStats, error) {
+	if sp, ok := q.sd.(storage.StatsProvider); ok {
+		return sp.Stats()
+	}
+	return nil, nil
+}
+
+// Flush makes the accumulating envelopes of the queues found by name
+// available now. It returns the number of flushed envelopes per queue.
+func (q *Manager) Flush(name string) (map[string]int, error) {
+	f, ok := q.sd.(storage.Flusher)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	out := make(map[string]int)
+	for _, v := range q.root.findQueue(split(name)) {
+		n, err := f.Flush(v.name())
+		if err != nil {
+			return out, err
+		}
+		if n > 0 {
+			out[v.name()] = n
+		}
+	}
+	return out, nil
+}
+
+// Shutdown makes waiting dequeue requests return ErrEmpty immediately and
+// closes subscriptions. Dequeue does not wait for messages after that.
+func (q *Manager) Shutdown() {
+	q.waits.closeAll()
+	q.subs.closeAll()
+}
+
+// Check verifies that the storage driver is usable if the driver supports
+// it.
+func (q *Manager) Check() error {
+	if c, ok := q.sd.(storage.Checker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// Waiters returns the number of waiting dequeue requests.
+func (q *Manager) Waiters() int {
+	return q.waits.len()
 }
 
 func (q *Manager) Properties(name string, inherit bool) *Properties {
@@ -162,16 +454,103 @@ func (q *Manager) Properties(name string, inherit bool) *Properties {
 	return nil
 }
 
-func (q *Manager) SetProperties(name string, props *Properties) {
+// SetProperties sets the properties of the queue. They are persisted if the
+// storage driver supports it. Nil props removes them.
+func (q *Manager) SetProperties(name string, props *Properties) error {
+	return q.setProperties(name, props, true)
+}
+
+// ConfigureProperties is like SetProperties but does not persist the
+// properties. It is for properties from a config file, which is applied again
+// on every start.
+func (q *Manager) ConfigureProperties(name string, props *Properties) error {
+	return q.setProperties(name, props, false)
+}
+
+func (q *Manager) setProperties(name string, props *Properties, persist bool) error {
+	if isPattern(split(name)) {
+		return ErrInvalidName
+	}
+	if props != nil && props.Backoff != nil {
+		if err := props.Backoff.validate(); err != nil {
+			return err
+		}
+	}
+	if ps, ok := q.sd.(storage.PropertyStore); ok && persist {
+		var b []byte
+		if props != nil {
+			var err error
+			if b, err = json.Marshal(props); err != nil {
+				return err
+			}
+		}
+		if err := ps.SaveProperties(name, b); err != nil {
+			return err
+		}
+	}
 	q.root.setProperties(split(name), props)
+	return nil
+}
+
+// loadQueues adds the queues stored by the storage driver to the tree so
+// that patterns match them after restart.
+func (q *Manager) loadQueues() error {
+	ql, ok := q.sd.(storage.QueueLister)
+	if !ok {
+		return nil
+	}
+	names, err := ql.Queues()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		q.root.lookup(split(name))
+	}
+	return nil
+}
+
+// loadProperties restores the properties persisted by the storage driver.
+// Records which cannot be decoded are skipped.
+func (q *Manager) loadProperties() error {
+	ps, ok := q.sd.(storage.PropertyStore)
+	if !ok {
+		return nil
+	}
+	all, err := ps.LoadProperties()
+	if err != nil {
+		return err
+	}
+	for name, b := range all {
+		props := NewProperties()
+		if err := json.Unmarshal(b, props); err != nil {
+			log.Printf("Skip invalid properties of %s: %v", name, err)
+			continue
+		}
+		q.root.setProperties(split(name), props)
+	}
+	return nil
 }
 
 func (q *Manager) HandleEvent(et event.EventType, v interface{}) {
-	name := v.(string)
+	switch et {
+	case event.EventMessageAvailable:
+		q.handleAvailable(v.(string))
+	case event.EventMessageDiscarded:
+		metrics.Inc(metrics.Discards, v.(*storage.MessageEvent).Queue)
+	}
+}
+
+func (q *Manager) handleAvailable(name string) {
 	w := q.waits.find(name)
 	if w == nil {
 		return
 	}
+	keys := split(name)
+	b := q.dequeueLimits.get(q.root.declaredBy(keys, declaresRateLimit), q.root.properties(keys).RateLimit)
+	if b != nil && !q.ready(name, b) {
+		q.waits.reset(w)
+		return
+	}
 	eid, err := q.idg.Next()
 	if err != nil {
 		return
@@ -181,10 +560,15 @@ func (q *Manager) HandleEvent(et event.EventType, v interface{}) {
 		q.waits.reset(w)
 		return
 	}
+	if b != nil {
+		b.take()
+	}
+	e.Queue = name
 	setEID(e, eid)
 	err = w.handle(e)
 	q.waits.remove(w)
 	if err == nil {
+		delivered(e, event.EmitFromHandler)
 		return
 	}
 
@@ -193,12 +577,15 @@ func (q *Manager) HandleEvent(et event.EventType, v interface{}) {
 		if w = q.waits.find(name); w == nil {
 			// Unfortunately, a message is dequeued but there is no wait request.
 			// Here we need to insert the message into top of the queue.
-			q.sd.Reset(e.ID)
+			if q.sd.Reset(e.ID) == nil {
+				metrics.Inc(metrics.Resets, name)
+			}
 			return
 		}
 		err = w.handle(e)
 		q.waits.remove(w)
 		if err == nil {
+			delivered(e, event.EmitFromHandler)
 			return
 		}
 	}
@@ -214,6 +601,7 @@ func split(name string) []string {
 func newEnvelope(queue string, props *Properties, msg *storage.Message) *storage.Envelope {
 	e := storage.NewEnvelope()
 	e.Queue = queue
+	e.EnqueuedAt = time.Now()
 	if props.Retry != nil {
 		e.Retry = *props.Retry
 	}
@@ -226,6 +614,33 @@ func newEnvelope(queue string, props *Properties, msg *storage.Message) *storage
 	return e
 }
 
+// containsQueue reports whether the queues include the queue of name.
+func containsQueue(queues []*queue, name string) bool {
+	for _, v := range queues {
+		if v.name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// delivered records metrics of the envelope handed to a consumer. On the
+// dispatcher goroutine, emitf must be event.EmitFromHandler, otherwise
+// event.Emit.
+func delivered(e *storage.Envelope, emitf func(event.EventType, interface{})) {
+	metrics.Inc(metrics.Pops, e.Queue)
+	metrics.ObserveSince(metrics.TimeInQueue, e.Queue, e.EnqueuedAt)
+	emit(emitf, event.EventMessagePoped, e)
+}
+
+// emit emits the event of the envelope with emitf unless nobody handles it.
+func emit(emitf func(event.EventType, interface{}), et event.EventType, e *storage.Envelope) {
+	if !event.Handled(et) {
+		return
+	}
+	emitf(et, storage.NewMessageEvent(et, e))
+}
+
 func setEID(e *storage.Envelope, id uid.ID) {
 	if e != nil {
 		e.ID = id
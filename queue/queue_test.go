@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/storage/memory"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+	. "gopkg.in/check.v1"
+)
+
+type ManagerSuite struct{}
+
+var _ = Suite(&ManagerSuite{})
+
+func newManager(c *C, sd storage.Driver) *Manager {
+	idgen, err := uid.NewGenerator(0)
+	c.Assert(err, IsNil)
+	return NewManager(idgen, sd)
+}
+
+// basicDriver hides the optional interfaces of the wrapped driver.
+type basicDriver struct {
+	storage.Driver
+}
+
+func (s *ManagerSuite) TestExtendNotSupported(c *C) {
+	m := newManager(c, basicDriver{memory.New()})
+	_, err := m.Enqueue("jobs", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, IsNil)
+	e, err := m.Dequeue("jobs", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(m.Extend(e.ID, time.Minute), Equals, ErrNotSupported)
+	c.Assert(m.Release(e.ID), Equals, ErrNotSupported)
+	c.Assert(m.Ack(e.ID), IsNil)
+}
+
+func (s *ManagerSuite) TestAck(c *C) {
+	m := newManager(c, memory.New())
+	_, err := m.Enqueue("jobs", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, IsNil)
+	e, err := m.Dequeue("jobs", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(m.Ack(e.ID), IsNil)
+	c.Assert(m.Ack(e.ID), Equals, storage.ErrInvalidEphemeralID)
+}
+
+func (s *ManagerSuite) TestAccumMaxMessages(c *C) {
+	m := newManager(c, memory.New())
+	props := NewProperties().SetAccumTime(types.Duration(time.Minute)).SetAccumMaxMessages(2)
+	var flushed []bool
+	for _, body := range []string{"a", "b", "c"} {
+		metas, err := m.Enqueue("jobs", &storage.Message{Body: []byte(body)}, props, "")
+		c.Assert(err, IsNil)
+		flushed = append(flushed, metas["jobs"].Flushed)
+	}
+	c.Assert(flushed, DeepEquals, []bool{false, true, false})
+	e, err := m.Dequeue("jobs", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(e.Messages, HasLen, 2)
+	_, err = m.Dequeue("jobs", 0, nil)
+	c.Assert(err, Equals, storage.ErrEmpty)
+}
+
+func (s *ManagerSuite) TestAccumKey(c *C) {
+	m := newManager(c, memory.New())
+	props := NewProperties().SetAccumTime(types.Duration(20 * time.Millisecond))
+	for _, key := range []string{"u1", "u2", "u1"} {
+		_, err := m.Enqueue("jobs", &storage.Message{Body: []byte(key)}, props, key)
+		c.Assert(err, IsNil)
+	}
+	time.Sleep(30 * time.Millisecond)
+	counts := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		e, err := m.Dequeue("jobs", 0, nil)
+		c.Assert(err, IsNil)
+		counts[e.AccumKey] = len(e.Messages)
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"u1": 2, "u2": 1})
+}
+
+func (s *ManagerSuite) TestFlush(c *C) {
+	m := newManager(c, memory.New())
+	props := NewProperties().SetAccumTime(types.Duration(time.Minute))
+	for _, name := range []string{"flush/a", "flush/a", "flush/b"} {
+		_, err := m.Enqueue(name, &storage.Message{Body: []byte(name)}, props, "")
+		c.Assert(err, IsNil)
+	}
+	flushed, err := m.Flush("flush/*")
+	c.Assert(err, IsNil)
+	c.Assert(flushed, DeepEquals, map[string]int{"flush/a": 1, "flush/b": 1})
+	e, err := m.Dequeue("flush/a", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(e.Messages, HasLen, 2)
+}
+
+func (s *ManagerSuite) TestFlushNotSupported(c *C) {
+	m := newManager(c, basicDriver{memory.New()})
+	_, err := m.Flush("jobs")
+	c.Assert(err, Equals, ErrNotSupported)
+}
+
+func (s *ManagerSuite) TestBackoff(c *C) {
+	m := newManager(c, memory.New())
+	props := NewProperties().
+		SetTimeout(types.Duration(50 * time.Millisecond)).
+		SetBackoff(Backoff{Policy: "linear", Delay: types.Duration(100 * time.Millisecond)})
+	c.Assert(m.SetProperties("backoff", props), IsNil)
+	_, err := m.Enqueue("backoff", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, IsNil)
+	_, err = m.Dequeue("backoff", 0, nil)
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+	_, err = m.Dequeue("backoff", 0, nil)
+	c.Assert(err, Equals, storage.ErrEmpty)
+	time.Sleep(100 * time.Millisecond)
+	e, err := m.Dequeue("backoff", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(e.Attempts, Equals, 2)
+}
+
+func (s *ManagerSuite) TestBackoffRelease(c *C) {
+	m := newManager(c, memory.New())
+	props := NewProperties().
+		SetBackoff(Backoff{Policy: "constant", Delay: types.Duration(100 * time.Millisecond)})
+	c.Assert(m.SetProperties("backoff", props), IsNil)
+	_, err := m.Enqueue("backoff", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, IsNil)
+	e, err := m.Dequeue("backoff", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(m.Extend(e.ID, time.Minute), IsNil)
+	c.Assert(m.Release(e.ID), IsNil)
+	c.Assert(m.Ack(e.ID), Equals, storage.ErrInvalidEphemeralID)
+	_, err = m.Dequeue("backoff", 0, nil)
+	c.Assert(err, Equals, storage.ErrEmpty)
+	time.Sleep(150 * time.Millisecond)
+	e, err = m.Dequeue("backoff", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(e.Attempts, Equals, 2)
+}
+
+func (s *ManagerSuite) TestDeliveryInfo(c *C) {
+	m := newManager(c, memory.New())
+	start := time.Now()
+	_, err := m.Enqueue("jobs", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, IsNil)
+	var ids []uid.ID
+	for i := 1; i <= 2; i++ {
+		e, err := m.Dequeue("jobs", 0, nil)
+		c.Assert(err, IsNil)
+		c.Assert(e.Attempts, Equals, i)
+		c.Assert(e.MessageID, Not(Equals), uid.ID(0))
+		c.Assert(e.MessageID, Not(Equals), e.ID)
+		c.Assert(e.EnqueuedAt.Before(start) || e.EnqueuedAt.After(time.Now()), Equals, false)
+		ids = append(ids, e.MessageID)
+		c.Assert(m.Release(e.ID), IsNil)
+	}
+	c.Assert(ids[0], Equals, ids[1])
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yosisa/pluq/types"
+)
+
+var ErrRateLimited = errors.New("Error rate limit exceeded")
+
+// RateLimit allows at most Limit messages per Interval. Bursts up to Limit
+// are allowed.
+type RateLimit struct {
+	Limit    int            `json:"limit"`
+	Interval types.Duration `json:"interval"`
+}
+
+func (l *RateLimit) valid() bool {
+	return l.Limit > 0 && l.Interval > 0
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	rate   float64 // tokens per nanosecond
+	tokens float64
+	last   int64
+	wakeup map[string]bool
+	m      sync.Mutex
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	return &tokenBucket{
+		limit:  l,
+		rate:   float64(l.Limit) / float64(l.Interval),
+		tokens: float64(l.Limit),
+		last:   time.Now().UnixNano(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now().UnixNano()
+	b.tokens += float64(now-b.last) * b.rate
+	if max := float64(b.limit.Limit); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// ready reports whether a token is available without taking it. Otherwise,
+// it returns the time until the next token becomes available.
+func (b *tokenBucket) ready() (bool, time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill()
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1-b.tokens)/b.rate) + 1
+}
+
+// take takes a token. The bucket may go into debt if it is called after
+// ready by concurrent requests, which delays the next token.
+func (b *tokenBucket) take() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill()
+	b.tokens--
+}
+
+// notifyAfter calls f with the name after d. Names already pending are
+// notified only once. A bucket shared by several queues notifies all of
+// them by one timer.
+func (b *tokenBucket) notifyAfter(d time.Duration, name string, f func(string)) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.wakeup[name] {
+		return
+	}
+	if len(b.wakeup) == 0 {
+		time.AfterFunc(d, func() {
+			b.m.Lock()
+			names := b.wakeup
+			b.wakeup = nil
+			b.m.Unlock()
+			for name := range names {
+				f(name)
+			}
+		})
+	}
+	if b.wakeup == nil {
+		b.wakeup = make(map[string]bool)
+	}
+	b.wakeup[name] = true
+}
+
+type rateLimiters struct {
+	buckets map[string]*tokenBucket
+	m       sync.Mutex
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{buckets: make(map[string]*tokenBucket)}
+}
+
+// get returns the bucket of the node declaring the rate limit, so that the
+// queues under the node share it. It returns nil if there is no rate limit.
+// The bucket is recreated when the limit is changed.
+func (r *rateLimiters) get(name string, l *RateLimit) *tokenBucket {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if l == nil || !l.valid() {
+		delete(r.buckets, name)
+		return nil
+	}
+	b := r.buckets[name]
+	if b == nil || b.limit != *l {
+		b = newTokenBucket(*l)
+		r.buckets[name] = b
+	}
+	return b
+}
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/storage/memory"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestTokenBucket(c *C) {
+	b := newTokenBucket(RateLimit{Limit: 2, Interval: types.Duration(100 * time.Millisecond)})
+	for i := 0; i < 2; i++ {
+		ok, _ := b.ready()
+		c.Assert(ok, Equals, true)
+		b.take()
+	}
+	ok, d := b.ready()
+	c.Assert(ok, Equals, false)
+	c.Assert(d > 0 && d <= 50*time.Millisecond, Equals, true)
+
+	time.Sleep(d)
+	ok, _ = b.ready()
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RateLimitSuite) TestNotifyAfter(c *C) {
+	b := newTokenBucket(RateLimit{Limit: 1, Interval: types.Duration(time.Second)})
+	called := make(chan string, 3)
+	f := func(name string) { called <- name }
+	b.notifyAfter(10*time.Millisecond, "a", f)
+	b.notifyAfter(10*time.Millisecond, "a", f)
+	b.notifyAfter(10*time.Millisecond, "b", f)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(called, HasLen, 2)
+}
+
+func (s *RateLimitSuite) TestRateLimiters(c *C) {
+	r := newRateLimiters()
+	c.Assert(r.get("a", nil), IsNil)
+	c.Assert(r.get("a", &RateLimit{}), IsNil)
+
+	l := RateLimit{Limit: 1, Interval: types.Duration(time.Second)}
+	b := r.get("a", &l)
+	c.Assert(b, NotNil)
+	c.Assert(r.get("a", &l), Equals, b)
+	c.Assert(r.get("b", &l), Not(Equals), b)
+
+	l.Limit = 2
+	c.Assert(r.get("a", &l), Not(Equals), b)
+}
+
+func (s *RateLimitSuite) TestInheritance(c *C) {
+	root := newNode()
+	l := RateLimit{Limit: 10, Interval: types.Duration(time.Second)}
+	root.setProperties([]string{"a"}, NewProperties().SetRateLimit(l))
+	props := root.properties([]string{"a", "b"})
+	c.Assert(props.RateLimit, DeepEquals, &l)
+	c.Assert(props.EnqueueRateLimit, IsNil)
+}
+
+func (s *RateLimitSuite) TestDeclaredBy(c *C) {
+	root := newNode()
+	l := RateLimit{Limit: 10, Interval: types.Duration(time.Second)}
+	root.setProperties([]string{"a"}, NewProperties().SetRateLimit(l))
+	c.Assert(root.declaredBy([]string{"a", "b", "c"}, declaresRateLimit), Equals, "a")
+	c.Assert(root.declaredBy([]string{"x", "y"}, declaresRateLimit), Equals, "x/y")
+}
+
+func (s *RateLimitSuite) TestSharedRateLimit(c *C) {
+	idgen, err := uid.NewGenerator(0)
+	c.Assert(err, IsNil)
+	m := NewManager(idgen, memory.New())
+	l := RateLimit{Limit: 1, Interval: types.Duration(time.Hour)}
+	c.Assert(m.SetProperties("jobs", NewProperties().SetEnqueueRateLimit(l)), IsNil)
+	_, err = m.Enqueue("jobs/a", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, IsNil)
+	_, err = m.Enqueue("jobs/b", &storage.Message{Body: []byte("x")}, nil, "")
+	c.Assert(err, Equals, ErrRateLimited)
+}
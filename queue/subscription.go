@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/storage"
+)
+
+// Subscription receives the message events of the queues under its
+// prefixes. Events are dropped while C is full so that a slow subscriber
+// never blocks the event dispatcher.
+type Subscription struct {
+	C        <-chan *storage.MessageEvent
+	c        chan *storage.MessageEvent
+	prefixes []string
+	done     chan struct{}
+	close    sync.Once
+	unsub    func()
+	subs     *subscriptions
+}
+
+func (s *Subscription) HandleEvent(et event.EventType, v interface{}) {
+	me, ok := v.(*storage.MessageEvent)
+	if !ok || !s.match(me.Queue) {
+		return
+	}
+	select {
+	case s.c <- me:
+	default:
+	}
+}
+
+func (s *Subscription) match(queue string) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if prefix == "" || queue == prefix || strings.HasPrefix(queue, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Done is closed when the subscription is closed by Close or by the
+// shutdown of the manager.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) Close() {
+	s.close.Do(func() {
+		s.unsub()
+		s.subs.remove(s)
+		close(s.done)
+	})
+}
+
+type subscriptions struct {
+	set    map[*Subscription]struct{}
+	closed bool
+	m      sync.Mutex
+}
+
+// add returns false if the subscriptions are already closed.
+func (s *subscriptions) add(sub *Subscription) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.set == nil {
+		s.set = make(map[*Subscription]struct{})
+	}
+	s.set[sub] = struct{}{}
+	return true
+}
+
+func (s *subscriptions) remove(sub *Subscription) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.set, sub)
+}
+
+func (s *subscriptions) closeAll() {
+	s.m.Lock()
+	s.closed = true
+	subs := make([]*Subscription, 0, len(s.set))
+	for sub := range s.set {
+		subs = append(subs, sub)
+	}
+	s.m.Unlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// Subscribe returns a subscription of the message events of the queues
+// under the prefixes, or of all queues if no prefix is given. Up to buffer
+// events are kept for the subscriber.
+func (q *Manager) Subscribe(prefixes []string, buffer int) *Subscription {
+	c := make(chan *storage.MessageEvent, buffer)
+	s := &Subscription{
+		C:        c,
+		c:        c,
+		prefixes: prefixes,
+		done:     make(chan struct{}),
+		subs:     &q.subs,
+	}
+	s.unsub = event.Subscribe(s)
+	if !q.subs.add(s) {
+		s.Close()
+	}
+	return s
+}
@@ -13,6 +13,7 @@ var errCanceled = errors.New("wait request has been canceled")
 type waiter interface {
 	match(string) (bool, error)
 	handle(*storage.Envelope) error
+	abort()
 }
 
 type waitItem struct {
@@ -21,14 +22,38 @@ type waitItem struct {
 }
 
 type waiters struct {
-	waits []*waitItem
-	m     sync.RWMutex
+	waits  []*waitItem
+	closed bool
+	m      sync.RWMutex
 }
 
-func (d *waiters) add(w waiter) {
+// add adds the waiter. It returns false if the waiters have been closed.
+func (d *waiters) add(w waiter) bool {
 	d.m.Lock()
 	defer d.m.Unlock()
+	if d.closed {
+		return false
+	}
 	d.waits = append(d.waits, &waitItem{w: w})
+	return true
+}
+
+// closeAll aborts all waiters and rejects new ones.
+func (d *waiters) closeAll() {
+	d.m.Lock()
+	waits := d.waits
+	d.waits = nil
+	d.closed = true
+	d.m.Unlock()
+	for _, wi := range waits {
+		wi.w.abort()
+	}
+}
+
+func (d *waiters) len() int {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	return len(d.waits)
 }
 
 func (d *waiters) remove(w waiter) {
@@ -104,20 +129,23 @@ START:
 
 type waitRequest struct {
 	root   *node
-	keys   []string
+	keys   [][]string
 	c      chan *storage.Envelope
 	cancel <-chan struct{}
 	timer  *time.Timer
+	closed bool
 	m      sync.Mutex
 }
 
-func newWaitRequest(root *node, name string, wait time.Duration, cancel <-chan struct{}) *waitRequest {
+func newWaitRequest(root *node, keys [][]string, wait time.Duration, cancel <-chan struct{}) *waitRequest {
 	w := &waitRequest{
 		root:   root,
-		keys:   split(name),
+		keys:   keys,
 		c:      make(chan *storage.Envelope),
 		cancel: cancel,
 	}
+	w.m.Lock()
+	defer w.m.Unlock()
 	w.timer = time.AfterFunc(wait, func() {
 		w.m.Lock()
 		defer w.m.Unlock()
@@ -132,7 +160,7 @@ func (w *waitRequest) match(name string) (bool, error) {
 	if w.isCanceled() {
 		return false, errCanceled
 	}
-	for _, v := range w.root.findQueue(w.keys) {
+	for _, v := range w.root.findQueues(w.keys) {
 		if v.name() == name {
 			return true, nil
 		}
@@ -151,6 +179,14 @@ func (w *waitRequest) handle(e *storage.Envelope) error {
 	return nil
 }
 
+// abort makes the wait request return with no envelope unless it has
+// already finished.
+func (w *waitRequest) abort() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.close()
+}
+
 // isCanceled returns true if the wait request has been canceled. It assumes
 // that this function is never called after handle is called.
 func (w *waitRequest) isCanceled() bool {
@@ -164,7 +200,13 @@ func (w *waitRequest) isCanceled() bool {
 	}
 }
 
+// close closes the channel unless it is already closed. The timer callback
+// may be waiting for the lock while the request is closed by others.
 func (w *waitRequest) close() {
+	if w.closed {
+		return
+	}
+	w.closed = true
 	w.timer.Stop()
 	close(w.c)
 }
@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type WaitSuite struct{}
+
+var _ = Suite(&WaitSuite{})
+
+func (s *WaitSuite) TestCloseAll(c *C) {
+	var ws waiters
+	w := newWaitRequest(newNode(), [][]string{{"a"}}, time.Minute, nil)
+	c.Assert(ws.add(w), Equals, true)
+
+	ws.closeAll()
+	_, ok := <-w.c
+	c.Assert(ok, Equals, false)
+	c.Assert(ws.len(), Equals, 0)
+
+	w = newWaitRequest(newNode(), [][]string{{"a"}}, time.Minute, nil)
+	c.Assert(ws.add(w), Equals, false)
+	w.abort()
+	w.abort()
+}
+
+func (s *WaitSuite) TestAbortBeforeTimer(c *C) {
+	w := newWaitRequest(newNode(), [][]string{{"a"}}, time.Millisecond, nil)
+	w.m.Lock()
+	time.Sleep(10 * time.Millisecond) // the timer callback waits for the lock
+	w.close()
+	w.m.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	_, ok := <-w.c
+	c.Assert(ok, Equals, false)
+}
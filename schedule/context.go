@@ -0,0 +1,18 @@
+package schedule
+
+import "golang.org/x/net/context"
+
+type key int
+
+const schedulerKey key = iota
+
+func NewContext(ctx context.Context, s *Scheduler) context.Context {
+	return context.WithValue(ctx, schedulerKey, s)
+}
+
+func FromContext(ctx context.Context) *Scheduler {
+	if s, ok := ctx.Value(schedulerKey).(*Scheduler); ok {
+		return s
+	}
+	return nil
+}
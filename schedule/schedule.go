@@ -0,0 +1,243 @@
+// Package schedule enqueues messages periodically by cron expressions.
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/storage"
+)
+
+var (
+	ErrNotFound        = errors.New("Error schedule not found")
+	ErrInvalidCron     = errors.New("Error invalid cron expression")
+	ErrInvalidTimezone = errors.New("Error invalid timezone")
+	ErrNoQueue         = errors.New("Error schedule has no queue")
+)
+
+// Schedule pushes a message with Body to Queue on every tick of Cron. Cron
+// is a standard 5-field expression or a descriptor such as @hourly, and is
+// evaluated in Timezone (UTC if empty).
+type Schedule struct {
+	Name        string `json:"name"`
+	Cron        string `json:"cron"`
+	Timezone    string `json:"timezone,omitempty"`
+	Queue       string `json:"queue"`
+	Body        string `json:"body"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type entry struct {
+	s    *Schedule
+	cron cron.Schedule
+	loc  *time.Location
+	stop chan struct{}
+}
+
+func newEntry(s *Schedule) (*entry, error) {
+	s.Queue = strings.Trim(s.Queue, "/")
+	if s.Queue == "" {
+		return nil, ErrNoQueue
+	}
+	if strings.ContainsAny(s.Queue, "*?[") {
+		return nil, queue.ErrInvalidName
+	}
+	c, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return nil, ErrInvalidCron
+	}
+	loc := time.UTC
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, ErrInvalidTimezone
+		}
+	}
+	// An expression such as "0 0 30 2 *" parses but never fires.
+	if c.Next(time.Now().In(loc)).IsZero() {
+		return nil, ErrInvalidCron
+	}
+	return &entry{s: s, cron: c, loc: loc, stop: make(chan struct{})}, nil
+}
+
+func (e *entry) copy() *Schedule {
+	s := *e.s
+	return &s
+}
+
+func (e *entry) run(q *queue.Manager) {
+	for {
+		now := time.Now().In(e.loc)
+		next := e.cron.Next(now)
+		if next.IsZero() {
+			log.Printf("Stop schedule %s which fires no more", e.s.Name)
+			return
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+			msg := &storage.Message{
+				ContentType: e.s.ContentType,
+				Body:        []byte(e.s.Body),
+			}
+			if _, err := q.Enqueue(e.s.Queue, msg, nil, ""); err != nil {
+				log.Printf("Failed to enqueue by schedule %s: %v", e.s.Name, err)
+			}
+		case <-e.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Scheduler runs schedules. Schedules are persisted if the storage driver
+// supports it.
+type Scheduler struct {
+	q       *queue.Manager
+	store   storage.ScheduleStore
+	entries map[string]*entry
+	m       sync.Mutex
+}
+
+// New returns a scheduler running the schedules stored in the storage
+// driver.
+func New(q *queue.Manager, sd storage.Driver) (*Scheduler, error) {
+	s := &Scheduler{q: q, entries: make(map[string]*entry)}
+	if store, ok := sd.(storage.ScheduleStore); ok {
+		s.store = store
+		all, err := store.LoadSchedules()
+		if err != nil {
+			return nil, err
+		}
+		for name, b := range all {
+			var sc Schedule
+			if err := json.Unmarshal(b, &sc); err != nil {
+				log.Printf("Skip undecodable schedule %s: %v", name, err)
+				continue
+			}
+			e, err := newEntry(&sc)
+			if err != nil {
+				log.Printf("Skip invalid schedule %s: %v", name, err)
+				continue
+			}
+			s.start(e)
+		}
+	}
+	return s, nil
+}
+
+func (s *Scheduler) start(e *entry) {
+	if old := s.entries[e.s.Name]; old != nil {
+		close(old.stop)
+	}
+	s.entries[e.s.Name] = e
+	go e.run(s.q)
+}
+
+// Put creates or replaces the schedule.
+func (s *Scheduler) Put(sc *Schedule) error {
+	return s.PutIf(sc, nil)
+}
+
+// PutIf is like Put but calls check with a copy of the schedule being
+// replaced, or nil, and fails with its error if any. The check and the put
+// are atomic.
+func (s *Scheduler) PutIf(sc *Schedule, check func(old *Schedule) error) error {
+	e, err := newEntry(sc)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if check != nil {
+		var old *Schedule
+		if e := s.entries[sc.Name]; e != nil {
+			old = e.copy()
+		}
+		if err := check(old); err != nil {
+			return err
+		}
+	}
+	if s.store != nil {
+		b, err := json.Marshal(sc)
+		if err != nil {
+			return err
+		}
+		if err := s.store.SaveSchedule(sc.Name, b); err != nil {
+			return err
+		}
+	}
+	s.start(e)
+	return nil
+}
+
+// Get returns a copy of the schedule.
+func (s *Scheduler) Get(name string) (*Schedule, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e := s.entries[name]
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	return e.copy(), nil
+}
+
+// List returns copies of all schedules sorted by name.
+func (s *Scheduler) List() []*Schedule {
+	s.m.Lock()
+	defer s.m.Unlock()
+	names := make([]string, 0, len(s.entries))
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*Schedule, len(names))
+	for i, name := range names {
+		out[i] = s.entries[name].copy()
+	}
+	return out
+}
+
+func (s *Scheduler) Delete(name string) error {
+	return s.DeleteIf(name, nil)
+}
+
+// DeleteIf is like Delete but calls check with a copy of the schedule first
+// and fails with its error if any. The check and the delete are atomic.
+func (s *Scheduler) DeleteIf(name string, check func(*Schedule) error) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e := s.entries[name]
+	if e == nil {
+		return ErrNotFound
+	}
+	if check != nil {
+		if err := check(e.copy()); err != nil {
+			return err
+		}
+	}
+	if s.store != nil {
+		if err := s.store.SaveSchedule(name, nil); err != nil {
+			return err
+		}
+	}
+	close(e.stop)
+	delete(s.entries, name)
+	return nil
+}
+
+// Stop stops all schedules.
+func (s *Scheduler) Stop() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for name, e := range s.entries {
+		close(e.stop)
+		delete(s.entries, name)
+	}
+}
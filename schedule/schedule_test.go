@@ -0,0 +1,128 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/storage/memory"
+	"github.com/yosisa/pluq/uid"
+)
+
+func newScheduler(t *testing.T) (*Scheduler, *queue.Manager) {
+	idgen, err := uid.NewGenerator(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := queue.NewManager(idgen, memory.New())
+	s, err := New(m, memory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, m
+}
+
+func TestPutInvalid(t *testing.T) {
+	s, _ := newScheduler(t)
+	defer s.Stop()
+	for _, c := range []struct {
+		sc  Schedule
+		err error
+	}{
+		{Schedule{Name: "a", Cron: "* * * * *"}, ErrNoQueue},
+		{Schedule{Name: "a", Cron: "* * * * *", Queue: "jobs/*"}, queue.ErrInvalidName},
+		{Schedule{Name: "a", Cron: "* * *", Queue: "jobs"}, ErrInvalidCron},
+		{Schedule{Name: "a", Cron: "0 0 30 2 *", Queue: "jobs"}, ErrInvalidCron},
+		{Schedule{Name: "a", Cron: "* * * * *", Queue: "jobs", Timezone: "Nowhere/City"}, ErrInvalidTimezone},
+	} {
+		if err := s.Put(&c.sc); err != c.err {
+			t.Errorf("Expected %v but %v for %+v", c.err, err, c.sc)
+		}
+	}
+	if len(s.List()) != 0 {
+		t.Fatalf("Expected no schedules but %v", s.List())
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	go event.Dispatch()
+	s, m := newScheduler(t)
+	defer s.Stop()
+	sc := &Schedule{Name: "tick", Cron: "@every 1s", Queue: "jobs", Body: "hello", ContentType: "text/plain"}
+	if err := s.Put(sc); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get("tick")
+	if err != nil || *got != *sc {
+		t.Fatalf("Expected %+v but %+v, %v", sc, got, err)
+	}
+	got.Queue = "other"
+	if got, _ := s.Get("tick"); got.Queue != "jobs" {
+		t.Fatalf("Get returned a shared schedule %+v", got)
+	}
+
+	e, err := m.Dequeue("jobs", 3*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := e.Messages[0]; string(msg.Body) != "hello" || msg.ContentType != "text/plain" {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	if err := s.Delete("tick"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("tick"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound but %v", err)
+	}
+}
+
+type scheduleStore struct {
+	*memory.Driver
+	schedules map[string][]byte
+}
+
+func (s *scheduleStore) SaveSchedule(name string, b []byte) error {
+	if b == nil {
+		delete(s.schedules, name)
+	} else {
+		s.schedules[name] = b
+	}
+	return nil
+}
+
+func (s *scheduleStore) LoadSchedules() (map[string][]byte, error) {
+	return s.schedules, nil
+}
+
+func TestLoadSkipsBadRecords(t *testing.T) {
+	idgen, err := uid.NewGenerator(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := queue.NewManager(idgen, memory.New())
+	store := &scheduleStore{memory.New(), map[string][]byte{
+		"good": []byte(`{"name":"good","cron":"@every 1h","queue":"jobs"}`),
+		"bad":  []byte(`{`),
+	}}
+	s, err := New(m, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if l := s.List(); len(l) != 1 || l[0].Name != "good" {
+		t.Fatalf("Expected only the good schedule but %+v", l)
+	}
+}
+
+func TestPutNormalizesQueue(t *testing.T) {
+	s, _ := newScheduler(t)
+	defer s.Stop()
+	if err := s.Put(&Schedule{Name: "a", Cron: "@every 1h", Queue: "/jobs/"}); err != nil {
+		t.Fatal(err)
+	}
+	if sc, err := s.Get("a"); err != nil || sc.Queue != "jobs" {
+		t.Fatalf("Expected queue jobs but %+v, %v", sc, err)
+	}
+}
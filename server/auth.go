@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/yosisa/pluq/auth"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/server/param"
+	"github.com/yosisa/pluq/uid"
+	"golang.org/x/net/context"
+)
+
+// authorize returns a middleware that permits the request only if the caller
+// is allowed to perform op on the requested queue. Authorization is disabled
+// when no token store is set in the context.
+func authorize(op auth.Operation) Middleware {
+	return authorizeFunc(func(ctx context.Context, r *http.Request, id *auth.Identity) bool {
+		return id.Allowed(op, queueName(ctx))
+	})
+}
+
+// authorizeAny is like authorize but for routes that have no queue. The
+// caller needs to be allowed to perform op on any queue.
+func authorizeAny(op auth.Operation) Middleware {
+	return authorizeFunc(func(ctx context.Context, r *http.Request, id *auth.Identity) bool {
+		return id.AllowedAny(op)
+	})
+}
+
+// authorizeMessage is like authorize but for routes that take the ephemeral
+// ID of a dequeued message. The queue is resolved from the ID. If it cannot
+// be resolved, the caller needs to be allowed on all queues.
+func authorizeMessage(op auth.Operation) Middleware {
+	return authorizeFunc(func(ctx context.Context, r *http.Request, id *auth.Identity) bool {
+		name := ""
+		if eid, err := uid.FromHashID(param.FromContext(ctx, "id")); err == nil {
+			if q := queue.FromContext(ctx); q != nil {
+				if v, err := q.QueueOf(eid); err == nil {
+					name = v
+				}
+			}
+		}
+		return id.Allowed(op, name)
+	})
+}
+
+// authorizeQueries is like authorize but for routes that take queues in the
+// queue query parameter. The caller needs to be allowed on all of them.
+func authorizeQueries(op auth.Operation) Middleware {
+	return authorizeFunc(func(ctx context.Context, r *http.Request, id *auth.Identity) bool {
+		for _, name := range queueNames(r) {
+			if !id.Allowed(op, name) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// allowed reports whether the identity authenticated by authorizeFunc may
+// perform op on the queue. It is true if authentication is disabled.
+func allowed(ctx context.Context, op auth.Operation, name string) bool {
+	id := auth.IdentityFromContext(ctx)
+	return id == nil || id.Allowed(op, name)
+}
+
+func authorizeFunc(allowed func(context.Context, *http.Request, *auth.Identity) bool) Middleware {
+	return func(h Handle) Handle {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			store := auth.FromContext(ctx)
+			if store == nil {
+				return h(ctx, w, r)
+			}
+			id, err := store.Authenticate(r)
+			if err != nil {
+				return err
+			}
+			if !allowed(ctx, r, id) {
+				return auth.ErrForbidden
+			}
+			return h(auth.WithIdentity(ctx, id), w, r)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yosisa/pluq/auth"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/schedule"
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/storage/memory"
+	"github.com/yosisa/pluq/uid"
+	"golang.org/x/net/context"
+)
+
+func TestAuthorizeMessage(t *testing.T) {
+	idgen, err := uid.NewGenerator(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := queue.NewManager(idgen, memory.New())
+	store, err := auth.NewStore([]*auth.Identity{
+		{Name: "a", Token: "atoken", Permissions: []auth.Permission{{Prefix: "a", Operations: []auth.Operation{auth.Consume}}}},
+		{Name: "b", Token: "btoken", Permissions: []auth.Permission{{Prefix: "b", Operations: []auth.Operation{auth.Consume}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := auth.NewContext(queue.NewContext(context.Background(), m), store)
+	h := New(ctx)
+
+	if _, err := m.Enqueue("a/x", &storage.Message{Body: []byte("x")}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	e, err := m.Dequeue("a/x", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{"btoken", http.StatusForbidden},
+		{"atoken", http.StatusOK},
+	} {
+		r := httptest.NewRequest("DELETE", "/v1/messages/"+e.ID.HashID(), nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("token %s: status = %d, want %d", c.token, w.Code, c.code)
+		}
+	}
+}
+
+func TestAuthorizeSchedule(t *testing.T) {
+	idgen, err := uid.NewGenerator(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := queue.NewManager(idgen, memory.New())
+	s, err := schedule.New(m, memory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	store, err := auth.NewStore([]*auth.Identity{
+		{Name: "a", Token: "atoken", Permissions: []auth.Permission{{Prefix: "a", Operations: []auth.Operation{auth.Admin}}}},
+		{Name: "b", Token: "btoken", Permissions: []auth.Permission{{Prefix: "b", Operations: []auth.Operation{auth.Admin}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := auth.NewContext(schedule.NewContext(queue.NewContext(context.Background(), m), s), store)
+	h := New(ctx)
+
+	for _, c := range []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"atoken", "PUT", "/v1/schedules/s", `{"cron":"@hourly","queue":"a/x"}`, http.StatusOK},
+		{"btoken", "PUT", "/v1/schedules/s", `{"cron":"@hourly","queue":"b/x"}`, http.StatusForbidden},
+		{"btoken", "PUT", "/v1/schedules/t", `{"cron":"@hourly","queue":"a/x"}`, http.StatusForbidden},
+		{"btoken", "GET", "/v1/schedules/s", "", http.StatusForbidden},
+		{"btoken", "DELETE", "/v1/schedules/s", "", http.StatusForbidden},
+		{"atoken", "GET", "/v1/schedules/s", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %s by %s: status = %d, want %d", c.method, c.path, c.token, w.Code, c.code)
+		}
+	}
+
+	for token, want := range map[string]int{"atoken": 1, "btoken": 0} {
+		r := httptest.NewRequest("GET", "/v1/schedules", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var list []*schedule.Schedule
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != want {
+			t.Errorf("schedules of %s = %s, want %d", token, w.Body, want)
+		}
+	}
+}
+
+func TestAuthorizeMetrics(t *testing.T) {
+	store, err := auth.NewStore([]*auth.Identity{
+		{Name: "a", Token: "atoken", Permissions: []auth.Permission{{Prefix: "a", Operations: []auth.Operation{auth.Admin}}}},
+		{Name: "b", Token: "btoken", Permissions: []auth.Permission{{Prefix: "b", Operations: []auth.Operation{auth.Consume}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(auth.NewContext(context.Background(), store))
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"btoken", http.StatusForbidden},
+		{"atoken", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("token %q: status = %d, want %d", c.token, w.Code, c.code)
+		}
+	}
+}
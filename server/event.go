@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/yosisa/pluq/auth"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
+	"golang.org/x/net/context"
+)
+
+// EventBuffer is the number of events kept for a slow events stream before
+// dropping them.
+var EventBuffer = 1000
+
+type jsonEvent struct {
+	Type          string         `json:"type"`
+	Time          time.Time      `json:"time"`
+	Queue         string         `json:"queue"`
+	MessageID     string         `json:"message_id,omitempty"`
+	Retry         types.Retry    `json:"retry"`
+	DeliveryCount int            `json:"delivery_count"`
+	Latency       types.Duration `json:"latency"`
+}
+
+func newJSONEvent(me *storage.MessageEvent) *jsonEvent {
+	e := &jsonEvent{
+		Type:          me.Type.String(),
+		Time:          me.Time,
+		Queue:         me.Queue,
+		Retry:         me.Retry,
+		DeliveryCount: me.Attempts,
+		Latency:       types.Duration(me.Latency),
+	}
+	if me.MessageID != 0 {
+		e.MessageID = me.MessageID.HashID()
+	}
+	return e
+}
+
+// events streams the message events of the queues under the prefixes given
+// in the queue query parameters as newline delimited JSON.
+func events(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := queue.FromContext(ctx)
+	sub := q.Subscribe(queueNames(r), EventBuffer)
+	defer sub.Close()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case me := <-sub.C:
+			if err := enc.Encode(newJSONEvent(me)); err != nil {
+				return nil
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-closed:
+			return nil
+		case <-sub.Done():
+			return nil
+		}
+	}
+}
+
+// authorizeEvents requires the consume permission on every prefix, or on
+// the root if no prefix is given.
+func authorizeEvents() Middleware {
+	return authorizeFunc(func(ctx context.Context, r *http.Request, id *auth.Identity) bool {
+		names := queueNames(r)
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, name := range names {
+			if !id.Allowed(auth.Consume, name) {
+				return false
+			}
+		}
+		return true
+	})
+}
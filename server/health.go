@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/queue"
+	"golang.org/x/net/context"
+)
+
+var ErrDraining = errors.New("Error server is draining")
+
+// DispatcherTimeout is the time to wait for the event dispatcher to respond
+// to a readiness check.
+var DispatcherTimeout = time.Second
+
+var draining int32
+
+// SetDraining marks the server as draining so that readiness checks fail
+// and load balancers stop sending new requests.
+func SetDraining(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&draining, v)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks"`
+}
+
+func healthz(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&checkResult{Status: "ok"})
+}
+
+func readyz(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	resp := &readiness{Status: "ok", Checks: make(map[string]*checkResult)}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Status = "fail"
+			resp.Checks[name] = &checkResult{Status: "fail", Error: err.Error()}
+		} else {
+			resp.Checks[name] = &checkResult{Status: "ok"}
+		}
+	}
+
+	var err error
+	if q := queue.FromContext(ctx); q != nil {
+		err = q.Check()
+	}
+	check("storage", err)
+	check("dispatcher", event.Ping(DispatcherTimeout))
+	err = nil
+	if isDraining() {
+		err = ErrDraining
+	}
+	check("draining", err)
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestReadyz(t *testing.T) {
+	defer func(d time.Duration) { DispatcherTimeout = d }(DispatcherTimeout)
+	DispatcherTimeout = 10 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	if err := readyz(context.Background(), w, httptest.NewRequest("GET", "/readyz", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	var resp readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Checks["dispatcher"].Status != "fail" || resp.Checks["storage"].Status != "ok" {
+		t.Errorf("unexpected checks: %+v", resp.Checks)
+	}
+}
+
+func TestProbesSkipMiddlewares(t *testing.T) {
+	var buf bytes.Buffer
+	h := New(context.Background(), AccessLog(&buf))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", w.Code)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected access log: %s", buf.String())
+	}
+}
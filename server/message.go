@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/yosisa/pluq/queue"
@@ -32,7 +35,10 @@ func push(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 		ContentType: r.Header.Get("Content-Type"),
 		Body:        b,
 	}
-	meta, err := q.Enqueue(name, msg, props)
+	if key := r.URL.Query().Get("dedup_key"); key != "" {
+		msg.Meta = map[string]interface{}{storage.MetaDedupKey: key}
+	}
+	meta, err := q.Enqueue(name, msg, props, r.URL.Query().Get("accum_key"))
 	if err != nil {
 		return err
 	}
@@ -45,15 +51,18 @@ func push(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 
 type pushResult struct {
 	AccumState string `json:"accum_state"`
+	Flushed    bool   `json:"flushed,omitempty"`
 }
 
 func newPushResult(meta *storage.EnqueueMeta) *pushResult {
-	var r pushResult
+	r := pushResult{Flushed: meta.Flushed}
 	switch meta.AccumState {
 	case storage.AccumStarted:
 		r.AccumState = "started"
 	case storage.AccumAdded:
 		r.AccumState = "added"
+	case storage.AccumCoalesced:
+		r.AccumState = "coalesced"
 	default:
 		r.AccumState = "disabled"
 	}
@@ -61,7 +70,19 @@ func newPushResult(meta *storage.EnqueueMeta) *pushResult {
 }
 
 func pop(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	name := queueName(ctx)
+	return popQueues(ctx, w, r, []string{queueName(ctx)})
+}
+
+// popAny pops from the queues given in the query in order.
+func popAny(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	names := queueNames(r)
+	if len(names) == 0 {
+		return ErrNoQueue
+	}
+	return popQueues(ctx, w, r, names)
+}
+
+func popQueues(ctx context.Context, w http.ResponseWriter, r *http.Request, names []string) error {
 	q := queue.FromContext(ctx)
 	var wait time.Duration
 	if s := r.URL.Query().Get("wait"); s != "" {
@@ -74,18 +95,37 @@ func pop(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	var cancel chan struct{}
 	if cn, ok := w.(http.CloseNotifier); ok {
 		cancel = make(chan struct{})
+		closed := cn.CloseNotify()
+		done := make(chan struct{})
+		defer close(done)
 		go func() {
-			<-cn.CloseNotify()
-			close(cancel)
+			select {
+			case <-closed:
+				close(cancel)
+			case <-done:
+			}
 		}()
 	}
-	envelope, err := q.Dequeue(name, wait, cancel)
+	envelope, err := q.DequeueAny(names, wait, cancel)
 	if err != nil {
 		return err
 	}
+	if wantsJSON(r) {
+		return writeJSON(w, envelope)
+	}
 	return writeHTTP(w, envelope)
 }
 
+// flush makes the accumulating envelopes available now.
+func flush(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := queue.FromContext(ctx)
+	flushed, err := q.Flush(queueName(ctx))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(flushed)
+}
+
 func reply(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	eid, err := uid.FromHashID(param.FromContext(ctx, "id"))
 	if err != nil {
@@ -99,6 +139,36 @@ func reply(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func extend(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	eid, err := uid.FromHashID(param.FromContext(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil {
+		return err
+	}
+	q := queue.FromContext(ctx)
+	if err := q.Extend(eid, timeout); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok")
+	return nil
+}
+
+func release(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	eid, err := uid.FromHashID(param.FromContext(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	q := queue.FromContext(ctx)
+	if err := q.Release(eid); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok")
+	return nil
+}
+
 func newProperties(r *http.Request) (*queue.Properties, error) {
 	props := queue.NewProperties()
 	if s := r.URL.Query().Get("retry"); s != "" {
@@ -125,6 +195,41 @@ func newProperties(r *http.Request) (*queue.Properties, error) {
 		props.SetAccumTime(d)
 	}
 
+	if s := r.URL.Query().Get("accum_mode"); s != "" {
+		if _, err := storage.ParseAccumMode(s); err != nil {
+			return nil, err
+		}
+		props.SetAccumMode(s)
+	}
+
+	if s := r.URL.Query().Get("accum_max_wait"); s != "" {
+		d, err := types.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		props.SetAccumMaxWait(d)
+	}
+
+	if s := r.URL.Query().Get("accum_coalesce"); s != "" {
+		props.SetAccumCoalesce(asBool(s))
+	}
+
+	if s := r.URL.Query().Get("accum_max_messages"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		props.SetAccumMaxMessages(n)
+	}
+
+	if s := r.URL.Query().Get("accum_max_bytes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		props.SetAccumMaxBytes(n)
+	}
+
 	return props, nil
 }
 
@@ -133,6 +238,16 @@ func writeHTTP(w http.ResponseWriter, e *storage.Envelope) error {
 	w.Header().Set("X-Pluq-Queue-Name", e.Queue)
 	w.Header().Set("X-Pluq-Retry-Remaining", e.Retry.String())
 	w.Header().Set("X-Pluq-Timeout", e.Timeout.String())
+	w.Header().Set("X-Pluq-Delivery-Count", strconv.Itoa(e.Attempts))
+	if e.MessageID != 0 {
+		w.Header().Set("X-Pluq-Original-Id", e.MessageID.HashID())
+	}
+	if !e.EnqueuedAt.IsZero() {
+		w.Header().Set("X-Pluq-Enqueued-At", e.EnqueuedAt.UTC().Format(time.RFC3339Nano))
+	}
+	if e.AccumKey != "" {
+		w.Header().Set("X-Pluq-Accum-Key", e.AccumKey)
+	}
 	if !e.IsComposite() {
 		w.Header().Set("Content-Type", e.Messages[0].ContentType)
 		w.Write(e.Messages[0].Body)
@@ -140,6 +255,7 @@ func writeHTTP(w http.ResponseWriter, e *storage.Envelope) error {
 	}
 	mw := multipart.NewWriter(w)
 	defer mw.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
 	for _, msg := range e.Messages {
 		mh := make(textproto.MIMEHeader)
 		mh.Set("Content-Type", msg.ContentType)
@@ -151,3 +267,59 @@ func writeHTTP(w http.ResponseWriter, e *storage.Envelope) error {
 	}
 	return nil
 }
+
+// wantsJSON reports whether the client asks for the envelope in JSON by
+// format=json or the Accept header. A media range with q=0 is not acceptable.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	for _, s := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil || mt != "application/json" {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type jsonEnvelope struct {
+	ID            string                 `json:"id"`
+	OriginalID    string                 `json:"original_id,omitempty"`
+	Queue         string                 `json:"queue"`
+	Retry         types.Retry            `json:"retry"`
+	Timeout       types.Duration         `json:"timeout"`
+	DeliveryCount int                    `json:"delivery_count"`
+	EnqueuedAt    *time.Time             `json:"enqueued_at,omitempty"`
+	AccumKey      string                 `json:"accum_key,omitempty"`
+	Messages      []*storage.JSONMessage `json:"messages"`
+}
+
+func writeJSON(w http.ResponseWriter, e *storage.Envelope) error {
+	w.Header().Set("X-Pluq-Message-Id", e.ID.HashID())
+	w.Header().Set("Content-Type", "application/json")
+	je := &jsonEnvelope{
+		ID:            e.ID.HashID(),
+		Queue:         e.Queue,
+		Retry:         e.Retry,
+		Timeout:       e.Timeout,
+		DeliveryCount: e.Attempts,
+		AccumKey:      e.AccumKey,
+	}
+	if e.MessageID != 0 {
+		je.OriginalID = e.MessageID.HashID()
+	}
+	if !e.EnqueuedAt.IsZero() {
+		je.EnqueuedAt = &e.EnqueuedAt
+	}
+	for _, msg := range e.Messages {
+		je.Messages = append(je.Messages, storage.NewJSONMessage(msg))
+	}
+	return json.NewEncoder(w).Encode(je)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yosisa/pluq/storage"
+)
+
+func TestWantsJSON(t *testing.T) {
+	for _, c := range []struct {
+		url    string
+		accept string
+		want   bool
+	}{
+		{"/v1/queues/a", "", false},
+		{"/v1/queues/a?format=json", "", true},
+		{"/v1/queues/a", "text/plain, application/json;q=0.9", true},
+		{"/v1/queues/a", "application/json;q=0", false},
+		{"/v1/queues/a", "text/plain, application/json; q=0.0", false},
+		{"/v1/queues/a?format=raw", "application/json", false},
+	} {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header.Set("Accept", c.accept)
+		if got := wantsJSON(r); got != c.want {
+			t.Errorf("wantsJSON(%q, %q) = %v, want %v", c.url, c.accept, got, c.want)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	e := storage.NewEnvelope()
+	e.Queue = "a"
+	e.AddMessage(&storage.Message{ContentType: "application/json", Body: []byte(`{"x":1}`)})
+	e.AddMessage(&storage.Message{ContentType: "text/plain", Body: []byte("hi")})
+	w := httptest.NewRecorder()
+	if err := writeJSON(w, e); err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Queue    string
+		Messages []map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Queue != "a" || len(v.Messages) != 2 {
+		t.Fatalf("unexpected envelope: %s", w.Body)
+	}
+	if body, ok := v.Messages[0]["body"].(map[string]interface{}); !ok || body["x"] != 1.0 {
+		t.Errorf("expected inline JSON body: %v", v.Messages[0])
+	}
+	if v.Messages[1]["body_base64"] != "aGk=" {
+		t.Errorf("expected base64 body: %v", v.Messages[1])
+	}
+}
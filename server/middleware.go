@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/yosisa/pluq/server/param"
+	"golang.org/x/net/context"
+)
+
+type key int
+
+const requestIDKey key = iota
+
+// RequestIDFromContext returns the request ID assigned by RequestID.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// RequestID returns a middleware that assigns an ID to each request and
+// echoes it in the header of the response. An ID given by the client in
+// the same header is reused.
+func RequestID(header string) Middleware {
+	return func(h Handle) Handle {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			id := r.Header.Get(header)
+			if id == "" || len(id) > 128 {
+				id = newRequestID()
+			}
+			w.Header().Set(header, id)
+			return h(context.WithValue(ctx, requestIDKey, id), w, r)
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Recover returns a middleware that turns a panic in the handler into an
+// error so that the client gets 500 instead of a dropped connection.
+func Recover() Middleware {
+	return func(h Handle) Handle {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					buf := make([]byte, 4096)
+					buf = buf[:runtime.Stack(buf, false)]
+					log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, buf)
+					err = fmt.Errorf("internal server error")
+				}
+			}()
+			return h(ctx, w, r)
+		}
+	}
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Queue     string    `json:"queue,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Status    int       `json:"status"`
+	Size      int       `json:"size"`
+	Latency   float64   `json:"latency"`
+}
+
+// AccessLog returns a middleware that writes a JSON line per request to out.
+// Errors returned by the handler are written to the response here so that
+// the status is logged.
+func AccessLog(out io.Writer) Middleware {
+	var m sync.Mutex
+	return func(h Handle) Handle {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			if err := h(ctx, rw, r); err != nil {
+				handleError(ctx, rw, r, err)
+			}
+			entry := &accessLogEntry{
+				Time:      start,
+				RequestID: RequestIDFromContext(ctx),
+				Remote:    r.RemoteAddr,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Queue:     queueName(ctx),
+				MessageID: rw.Header().Get("X-Pluq-Message-Id"),
+				Status:    rw.status,
+				Size:      rw.size,
+				Latency:   time.Since(start).Seconds(),
+			}
+			if entry.MessageID == "" {
+				entry.MessageID = param.FromContext(ctx, "id")
+			}
+			// The response is already written, so failures are only logged
+			b, err := json.Marshal(entry)
+			if err != nil {
+				log.Printf("Failed to encode access log: %v", err)
+				return nil
+			}
+			m.Lock()
+			defer m.Unlock()
+			if _, err = out.Write(append(b, '\n')); err != nil {
+				log.Printf("Failed to write access log: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+// responseWriter records the status and the size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMiddlewares(t *testing.T) {
+	var buf bytes.Buffer
+	f := apiFactory(context.Background(), RequestID("X-Request-Id"), AccessLog(&buf), Recover())
+	h := f(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/queues/a", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	h(w, r, nil)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if id := w.Header().Get("X-Request-Id"); id != "abc" {
+		t.Errorf("request id = %q, want abc", id)
+	}
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != http.StatusInternalServerError || entry.RequestID != "abc" || entry.Method != "GET" {
+		t.Errorf("unexpected log entry: %+v", entry)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	f := apiFactory(context.Background(), RequestID("X-Request-Id"))
+	var got string
+	h := f(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		got = RequestIDFromContext(ctx)
+		return nil
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil), nil)
+	if got == "" || w.Header().Get("X-Request-Id") != got {
+		t.Errorf("request id = %q, header = %q", got, w.Header().Get("X-Request-Id"))
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAccessLogWriteError(t *testing.T) {
+	h := AccessLog(failingWriter{})(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+	w := httptest.NewRecorder()
+	if err := h(context.Background(), w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatalf("Expected no error but %v", err)
+	}
+	if w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want 201", w.Code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/storage"
 	"golang.org/x/net/context"
 )
 
@@ -20,8 +21,12 @@ func setProperties(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	if err := json.Unmarshal(b, props); err != nil {
 		return err
 	}
-	q.SetProperties(name, props)
-	return nil
+	if props.AccumMode != nil {
+		if _, err := storage.ParseAccumMode(*props.AccumMode); err != nil {
+			return err
+		}
+	}
+	return q.SetProperties(name, props)
 }
 
 func getProperties(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
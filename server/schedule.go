@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/yosisa/pluq/auth"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/schedule"
+	"github.com/yosisa/pluq/server/param"
+	"golang.org/x/net/context"
+)
+
+// listSchedules lists the schedules whose queues the caller may administer.
+func listSchedules(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	s := schedule.FromContext(ctx)
+	if s == nil {
+		return queue.ErrNotSupported
+	}
+	out := []*schedule.Schedule{}
+	for _, sc := range s.List() {
+		if allowed(ctx, auth.Admin, sc.Queue) {
+			out = append(out, sc)
+		}
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+func getSchedule(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	s := schedule.FromContext(ctx)
+	if s == nil {
+		return queue.ErrNotSupported
+	}
+	sc, err := s.Get(param.FromContext(ctx, "name"))
+	if err != nil {
+		return err
+	}
+	if !allowed(ctx, auth.Admin, sc.Queue) {
+		return auth.ErrForbidden
+	}
+	return json.NewEncoder(w).Encode(sc)
+}
+
+// putSchedule creates or replaces the schedule. The caller needs to be
+// allowed to produce to its queue, and to administer the queue of the
+// schedule being replaced.
+func putSchedule(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	s := schedule.FromContext(ctx)
+	if s == nil {
+		return queue.ErrNotSupported
+	}
+	var sc schedule.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		return err
+	}
+	sc.Name = param.FromContext(ctx, "name")
+	sc.Queue = strings.Trim(sc.Queue, "/")
+	if !allowed(ctx, auth.Produce, sc.Queue) {
+		return auth.ErrForbidden
+	}
+	return s.PutIf(&sc, func(old *schedule.Schedule) error {
+		if old != nil && !allowed(ctx, auth.Admin, old.Queue) {
+			return auth.ErrForbidden
+		}
+		return nil
+	})
+}
+
+func deleteSchedule(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	s := schedule.FromContext(ctx)
+	if s == nil {
+		return queue.ErrNotSupported
+	}
+	return s.DeleteIf(param.FromContext(ctx, "name"), func(sc *schedule.Schedule) error {
+		if !allowed(ctx, auth.Admin, sc.Queue) {
+			return auth.ErrForbidden
+		}
+		return nil
+	})
+}
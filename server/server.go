@@ -1,37 +1,73 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yosisa/pluq/auth"
+	"github.com/yosisa/pluq/queue"
+	"github.com/yosisa/pluq/schedule"
 	"github.com/yosisa/pluq/server/param"
 	"github.com/yosisa/pluq/storage"
 	"golang.org/x/net/context"
 )
 
+var ErrNoQueue = errors.New("Error no queue specified")
+
 type Handle func(context.Context, http.ResponseWriter, *http.Request) error
 
 type Middleware func(Handle) Handle
 
-func New(ctx context.Context) http.Handler {
-	f := apiFactory(ctx)
+// New returns a handler of the API. The middlewares are applied to every
+// API request, the first one being the outermost.
+func New(ctx context.Context, ms ...Middleware) http.Handler {
+	f := apiFactory(ctx, ms...)
 	router := httprouter.New()
-	router.GET("/v1/queues/*queue", f(pop))
-	router.POST("/v1/queues/*queue", f(push))
-	router.DELETE("/v1/messages/:id", f(reply))
+	router.GET("/v1/queues/*queue", f(pop, authorize(auth.Consume)))
+	router.GET("/v1/pop", f(popAny, authorizeQueries(auth.Consume)))
+	router.GET("/v1/events", f(events, authorizeEvents()))
+	// httprouter does not allow a suffix after the catch-all parameter
+	router.POST("/v1/flush/*queue", f(flush, authorize(auth.Produce)))
+	router.POST("/v1/queues/*queue", f(push, authorize(auth.Produce)))
+	router.DELETE("/v1/messages/:id", f(reply, authorizeMessage(auth.Consume)))
+	router.POST("/v1/messages/:id/extend", f(extend, authorizeMessage(auth.Consume)))
+	router.POST("/v1/messages/:id/release", f(release, authorizeMessage(auth.Consume)))
+
+	router.GET("/v1/properties/*queue", f(getProperties, authorize(auth.Admin)))
+	router.PUT("/v1/properties/*queue", f(setProperties, authorize(auth.Admin)))
 
-	router.GET("/v1/properties/*queue", f(getProperties))
-	router.PUT("/v1/properties/*queue", f(setProperties))
+	router.GET("/v1/schedules", f(listSchedules, authorizeAny(auth.Admin)))
+	router.GET("/v1/schedules/:name", f(getSchedule, authorizeAny(auth.Admin)))
+	router.PUT("/v1/schedules/:name", f(putSchedule, authorizeAny(auth.Admin)))
+	router.DELETE("/v1/schedules/:name", f(deleteSchedule, authorizeAny(auth.Admin)))
+
+	// Probes bypass the global middlewares to keep them out of access logs
+	probe := apiFactory(ctx)
+	router.GET("/healthz", probe(healthz))
+	router.GET("/readyz", probe(readyz))
+	router.GET("/metrics", probe(metricsHandle(promhttp.Handler()), authorizeAny(auth.Admin)))
 	return router
 }
 
-func apiFactory(rootCtx context.Context) func(h Handle, ms ...Middleware) httprouter.Handle {
+// metricsHandle serves the metrics which expose the queue names, so the
+// caller needs to be an administrator.
+func metricsHandle(h http.Handler) Handle {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		h.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+func apiFactory(rootCtx context.Context, global ...Middleware) func(h Handle, ms ...Middleware) httprouter.Handle {
 	if rootCtx == nil {
 		rootCtx = context.Background()
 	}
 	return func(h Handle, ms ...Middleware) httprouter.Handle {
+		ms = append(global[:len(global):len(global)], ms...)
 		for i := len(ms) - 1; i >= 0; i-- {
 			h = ms[i](h)
 		}
@@ -48,6 +84,26 @@ func handleError(ctx context.Context, w http.ResponseWriter, r *http.Request, er
 	switch err {
 	case storage.ErrEmpty:
 		w.WriteHeader(http.StatusNoContent)
+	case auth.ErrUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pluq"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, err)
+	case schedule.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, err)
+	case queue.ErrInvalidName, queue.ErrInvalidBackoff, storage.ErrInvalidAccumMode, ErrNoQueue,
+		schedule.ErrInvalidCron, schedule.ErrInvalidTimezone, schedule.ErrNoQueue:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+	case queue.ErrNotSupported:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintln(w, err)
+	case queue.ErrRateLimited:
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, err)
+	case auth.ErrForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, err)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, err)
@@ -65,3 +121,14 @@ func asBool(s string) bool {
 func queueName(ctx context.Context) string {
 	return strings.Trim(param.FromContext(ctx, "queue"), "/")
 }
+
+// queueNames returns the queues given in the queue query parameters.
+func queueNames(r *http.Request) []string {
+	var names []string
+	for _, name := range r.URL.Query()["queue"] {
+		if name = strings.Trim(name, "/"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
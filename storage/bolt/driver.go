@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,8 +18,17 @@ var (
 	bucketMessage    = []byte("message")
 	bucketSchedule   = []byte("schedule")
 	bucketReplyIndex = []byte("replyIndex")
+	bucketProperties = []byte("properties")
+	bucketRecurring  = []byte("schedules") // cron schedules
+	bucketMeta       = []byte("meta")
 )
 
+var keyLayout = []byte("layout")
+
+// layoutVersion is the version of the schedule data layout. Version 0 has
+// the accumulation key after the fixed 40 bytes, version 1 after 48 bytes.
+const layoutVersion = 1
+
 var (
 	ErrBucketNotFound  = errors.New("Error bucket not found")
 	ErrMessageNotFound = errors.New("Error message not found")
@@ -62,12 +72,16 @@ func (b scheduleKey) setAccumlating(enable bool) {
 
 type scheduleData []byte
 
-func newScheduleData(id uid.ID, retry int32, timeout int64) scheduleData {
-	n := 8 + 4*8
-	b := make([]byte, n, n)
+// newScheduleData returns schedule data. The accumulation key, if any, is
+// stored after the fixed 48 bytes.
+func newScheduleData(id uid.ID, retry int32, timeout int64, enqueuedAt int64, accumKey string) scheduleData {
+	n := 8 + 5*8
+	b := make([]byte, n+len(accumKey))
+	copy(b[n:], accumKey)
 	copy(b, id.Bytes())
 	binary.BigEndian.PutUint32(b[8:], uint32(retry))
 	binary.BigEndian.PutUint64(b[12:], uint64(timeout))
+	binary.BigEndian.PutUint64(b[20:], uint64(enqueuedAt))
 	return b
 }
 
@@ -87,6 +101,65 @@ func (b scheduleData) timeout() int64 {
 	return int64(binary.BigEndian.Uint64(b[12:]))
 }
 
+func (b scheduleData) enqueuedAt() int64 {
+	return int64(binary.BigEndian.Uint64(b[20:]))
+}
+
+// accum returns the number of messages and their total size of an
+// accumulating envelope.
+func (b scheduleData) accum() (int, int) {
+	return int(binary.BigEndian.Uint32(b[28:])), int(binary.BigEndian.Uint32(b[32:]))
+}
+
+func (b scheduleData) setAccum(n, size int) {
+	binary.BigEndian.PutUint32(b[28:], uint32(n))
+	binary.BigEndian.PutUint32(b[32:], uint32(size))
+}
+
+// attempts returns the number of deliveries.
+func (b scheduleData) attempts() int {
+	return int(binary.BigEndian.Uint32(b[36:]))
+}
+
+func (b scheduleData) setAttempts(n int) {
+	binary.BigEndian.PutUint32(b[36:], uint32(n))
+}
+
+// backoff returns the delay between the end of the lease and the time the
+// message becomes available again.
+func (b scheduleData) backoff() int64 {
+	if len(b) < 48 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b[40:]))
+}
+
+func (b scheduleData) setBackoff(d int64) {
+	binary.BigEndian.PutUint64(b[40:], uint64(d))
+}
+
+func (b scheduleData) accumKey() string {
+	if len(b) <= 48 {
+		return ""
+	}
+	return string(b[48:])
+}
+
+// envelope returns an envelope without messages.
+func (b scheduleData) envelope() *storage.Envelope {
+	e := &storage.Envelope{
+		MessageID: uid.ID(binary.BigEndian.Uint64(b.messageID())),
+		Retry:     b.retry(),
+		Timeout:   types.Duration(b.timeout()),
+		AccumKey:  b.accumKey(),
+		Attempts:  b.attempts(),
+	}
+	if t := b.enqueuedAt(); t != 0 {
+		e.EnqueuedAt = time.Unix(0, t)
+	}
+	return e
+}
+
 type replyData []byte
 
 func newReplyData(msgid []byte, skey scheduleKey) replyData {
@@ -109,8 +182,9 @@ func (b replyData) scheduleID() []byte {
 }
 
 type Driver struct {
-	db     *bolt.DB
-	closed chan struct{}
+	db      *bolt.DB
+	closed  chan struct{}
+	backoff func(*storage.Envelope) time.Duration
 }
 
 func New(dbpath string) (*Driver, error) {
@@ -118,6 +192,10 @@ func New(dbpath string) (*Driver, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	d := &Driver{
 		db:     db,
 		closed: make(chan struct{}),
@@ -126,6 +204,48 @@ func New(dbpath string) (*Driver, error) {
 	return d, nil
 }
 
+// migrate upgrades schedule data written by older versions to the current
+// layout.
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(keyLayout); len(v) > 0 && v[0] >= layoutVersion {
+			return nil
+		}
+		if schedule := tx.Bucket(bucketSchedule); schedule != nil {
+			// Insert the backoff before the accumulation key. Collect first
+			// since modifying the bucket invalidates the cursor.
+			olds := make(map[string][]byte)
+			c := schedule.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				olds[string(k)] = cloneBytes(v)
+			}
+			for k, v := range olds {
+				if len(v) < 40 {
+					continue
+				}
+				b := make([]byte, len(v)+8)
+				copy(b, v[:40])
+				copy(b[48:], v[40:])
+				if err := schedule.Put([]byte(k), b); err != nil {
+					return err
+				}
+			}
+			log.Printf("Migrated %d schedules to layout version %d", len(olds), layoutVersion)
+		}
+		return meta.Put(keyLayout, []byte{layoutVersion})
+	})
+}
+
+// SetBackoff sets the function of the backoff delay. It must be called
+// before the driver is used.
+func (d *Driver) SetBackoff(f func(*storage.Envelope) time.Duration) {
+	d.backoff = f
+}
+
 func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *storage.EnqueueOptions) (*storage.EnqueueMeta, error) {
 	msg, err := marshal(e)
 	if err != nil {
@@ -133,6 +253,7 @@ func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *sto
 	}
 
 	var meta storage.EnqueueMeta
+	size := len(e.Messages[0].Body)
 	if opts.AccumTime > 0 {
 		now := time.Now().UnixNano()
 		err = d.db.Update(func(tx *bolt.Tx) error {
@@ -149,21 +270,66 @@ func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *sto
 				}
 				if sk.queue() == queue && sk.accumlating() {
 					sd := scheduleData(v)
+					if sd.accumKey() != opts.AccumKey {
+						continue
+					}
 					b := message.Get(sd.messageID())
 					if b == nil {
 						continue
 					}
+					if opts.AccumCoalesce {
+						dup, err := containsDuplicate(b, e.Messages[0])
+						if err != nil {
+							return err
+						}
+						if dup {
+							meta.AccumState = storage.AccumCoalesced
+							return nil
+						}
+					}
 					meta.AccumState = storage.AccumAdded
 					data := make([]byte, len(b)+len(msg))
 					n := copy(data, b)
 					copy(data[n:], msg)
-					return message.Put(sd.messageID(), data)
+					if err := message.Put(sd.messageID(), data); err != nil {
+						return err
+					}
+
+					sd = append(scheduleData(nil), sd...)
+					count, total := sd.accum()
+					sd.setAccum(count+1, total+size)
+					t := sk.timestamp()
+					switch {
+					case opts.AccumFull(count+1, total+size):
+						// Make it available now
+						meta.Flushed = true
+						t = now
+					case opts.AccumMode == storage.AccumSliding:
+						t = opts.AccumUntil(sd.enqueuedAt(), now)
+					default:
+						return schedule.Put(k, sd)
+					}
+					if err := schedule.Delete(k); err != nil {
+						return err
+					}
+					skey := append(scheduleKey(nil), k...)
+					skey.setAccumlating(!meta.Flushed)
+					for ; ; t++ {
+						skey.setTimestamp(t)
+						if schedule.Get(skey) == nil {
+							break
+						}
+					}
+					return schedule.Put(skey, sd)
 				}
 			}
 			return ErrMessageNotFound
 		})
 		switch err {
 		case nil:
+			if meta.Flushed {
+				event.Emit(event.EventMessageAvailable, queue)
+			}
 			return &meta, nil
 		case ErrMessageNotFound, ErrBucketNotFound:
 		default:
@@ -171,17 +337,29 @@ func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *sto
 		}
 	}
 
+	now := time.Now().UnixNano()
+	enqueuedAt := e.EnqueuedAt.UnixNano()
+	if e.EnqueuedAt.IsZero() {
+		enqueuedAt = now
+	}
 	skey := newScheduleKey(queue)
-	if opts.AccumTime > 0 {
-		skey.setAccumlating(true)
+	sval := newScheduleData(id, int32(e.Retry), int64(e.Timeout), enqueuedAt, e.AccumKey)
+	accum := opts.AccumTime > 0
+	if accum {
 		meta.AccumState = storage.AccumStarted
-	}
-	sval := newScheduleData(id, int32(e.Retry), int64(e.Timeout))
-	for {
-		t := time.Now().UnixNano()
-		if opts.AccumTime > 0 {
-			t += int64(opts.AccumTime)
+		if opts.AccumFull(1, size) {
+			meta.Flushed = true
+			accum = false
+		} else {
+			skey.setAccumlating(true)
+			sval.setAccum(1, size)
 		}
+	}
+	t := now
+	if accum {
+		t = opts.AccumUntil(now, now)
+	}
+	for ; ; t++ {
 		skey.setTimestamp(t)
 		err := d.db.Update(func(tx *bolt.Tx) error {
 			message, err := tx.CreateBucketIfNotExists(bucketMessage)
@@ -203,7 +381,7 @@ func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *sto
 		})
 		if err == errConflict {
 			continue
-		} else if err == nil && opts.AccumTime == 0 {
+		} else if err == nil && !accum {
 			event.Emit(event.EventMessageAvailable, queue)
 		}
 		return &meta, err
@@ -213,6 +391,13 @@ func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *sto
 func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err error) {
 	var sd scheduleData
 	now := time.Now().UnixNano()
+	// Emit after the transaction since the handlers may call the driver.
+	var discarded []*storage.MessageEvent
+	defer func() {
+		for _, me := range discarded {
+			event.Emit(event.EventMessageDiscarded, me)
+		}
+	}()
 	err = d.db.Update(func(tx *bolt.Tx) error {
 		ridx, err := tx.CreateBucketIfNotExists(bucketReplyIndex)
 		if err != nil {
@@ -237,13 +422,15 @@ func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err err
 			if !sval.retry().IsValid() {
 				var envelope *storage.Envelope
 				if b := message.Get(sval.messageID()); b != nil {
-					envelope, _ = reconstruct(sval, b)
+					if envelope, _ = reconstruct(sval, b); envelope != nil {
+						envelope.Queue = skey.queue()
+					}
 				}
 				if err := schedule.Delete(k); err != nil {
 					return err
 				}
 				if envelope != nil {
-					event.Emit(event.EventMessageDiscarded, envelope)
+					discarded = append(discarded, storage.NewMessageEvent(event.EventMessageDiscarded, envelope))
 				}
 				continue
 			}
@@ -254,12 +441,19 @@ func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err err
 					return err
 				}
 
-				nextTick := now + sd.timeout()
-				newkey.setTimestamp(nextTick)
-				newkey.setAccumlating(false)
 				retry := sd.retry()
 				retry.Decr()
 				sd.setRetry(retry)
+				sd.setAttempts(sd.attempts() + 1)
+				var backoff int64
+				if d.backoff != nil {
+					e := sd.envelope()
+					e.Queue = queue
+					backoff = int64(d.backoff(e))
+				}
+				sd.setBackoff(backoff)
+				newkey.setTimestamp(now + sd.timeout() + backoff)
+				newkey.setAccumlating(false)
 				if err := schedule.Put(newkey, sd); err != nil {
 					return err
 				}
@@ -291,7 +485,7 @@ func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err err
 	return reconstruct(sd, data)
 }
 
-func (d *Driver) Ack(eid uid.ID) (err error) {
+func (d *Driver) Ack(eid uid.ID) error {
 	rd, err := d.findReplyData(eid)
 	if err != nil {
 		return err
@@ -315,6 +509,36 @@ func (d *Driver) Ack(eid uid.ID) (err error) {
 	})
 }
 
+func (d *Driver) EnvelopeOf(eid uid.ID) (*storage.Envelope, error) {
+	rd, err := d.findReplyData(eid)
+	if err != nil {
+		return nil, err
+	}
+	var e *storage.Envelope
+	err = d.db.View(func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(bucketSchedule)
+		if schedule == nil {
+			return ErrBucketNotFound
+		}
+		sv := schedule.Get(rd.scheduleID())
+		if sv == nil {
+			return storage.ErrInvalidEphemeralID
+		}
+		e = scheduleData(sv).envelope()
+		e.Queue = scheduleKey(rd.scheduleID()).queue()
+		return nil
+	})
+	return e, err
+}
+
+func (d *Driver) QueueOf(eid uid.ID) (string, error) {
+	rd, err := d.findReplyData(eid)
+	if err != nil {
+		return "", err
+	}
+	return scheduleKey(rd.scheduleID()).queue(), nil
+}
+
 func (d *Driver) Reset(eid uid.ID) error {
 	rd, err := d.findReplyData(eid)
 	if err != nil {
@@ -339,19 +563,224 @@ func (d *Driver) Reset(eid uid.ID) error {
 			return err
 		}
 		newkey.setTimestamp(0)
+		newval.setBackoff(0)
 		retry := newval.retry()
 		retry.Incr()
 		newval.setRetry(retry)
+		newval.setAttempts(newval.attempts() - 1)
 		return schedule.Put(newkey, newval)
 	})
 }
 
+func (d *Driver) Extend(eid uid.ID, timeout types.Duration) (*storage.Envelope, error) {
+	rd, err := d.findReplyData(eid)
+	if err != nil {
+		return nil, err
+	}
+	var e *storage.Envelope
+	var available bool
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(bucketSchedule)
+		if schedule == nil {
+			return ErrBucketNotFound
+		}
+		ridx := tx.Bucket(bucketReplyIndex)
+		if ridx == nil {
+			return ErrBucketNotFound
+		}
+		sv := schedule.Get(rd.scheduleID())
+		if sv == nil {
+			return storage.ErrInvalidEphemeralID
+		}
+		newkey := scheduleKey(cloneBytes(rd.scheduleID()))
+		newval := scheduleData(cloneBytes(sv))
+		if err := schedule.Delete(rd.scheduleID()); err != nil {
+			return err
+		}
+		for t := time.Now().UnixNano() + int64(timeout) + newval.backoff(); ; t++ {
+			newkey.setTimestamp(t)
+			if schedule.Get(newkey) == nil {
+				break
+			}
+		}
+		if err := schedule.Put(newkey, newval); err != nil {
+			return err
+		}
+		e = newval.envelope()
+		e.Queue = newkey.queue()
+		available = timeout == 0 && newval.backoff() == 0
+		return ridx.Put(eid.Bytes(), newReplyData(rd.messageID(), newkey))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if available {
+		event.Emit(event.EventMessageAvailable, e.Queue)
+	}
+	return e, nil
+}
+
+func (d *Driver) Stats() (map[string]*storage.QueueStats, error) {
+	now := time.Now().UnixNano()
+	out := make(map[string]*storage.QueueStats)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(bucketSchedule)
+		if schedule == nil {
+			return nil
+		}
+		c := schedule.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			skey := scheduleKey(k)
+			stats := out[skey.queue()]
+			if stats == nil {
+				stats = &storage.QueueStats{}
+				out[skey.queue()] = stats
+			}
+			if skey.timestamp()-scheduleData(v).backoff() > now && !skey.accumlating() {
+				stats.InFlight++
+			} else {
+				stats.Depth++
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (d *Driver) Flush(queue string) (int, error) {
+	now := time.Now().UnixNano()
+	var n int
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(bucketSchedule)
+		if schedule == nil {
+			return nil
+		}
+		var keys []scheduleKey
+		c := schedule.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			sk := scheduleKey(k)
+			if sk.timestamp() > now && sk.accumlating() && sk.queue() == queue {
+				keys = append(keys, scheduleKey(cloneBytes(k)))
+			}
+		}
+		for _, k := range keys {
+			sd := cloneBytes(schedule.Get(k))
+			if err := schedule.Delete(k); err != nil {
+				return err
+			}
+			k.setAccumlating(false)
+			for t := now; ; t++ {
+				k.setTimestamp(t)
+				if schedule.Get(k) == nil {
+					break
+				}
+			}
+			if err := schedule.Put(k, sd); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		event.Emit(event.EventMessageAvailable, queue)
+	}
+	return n, nil
+}
+
+func (d *Driver) Queues() ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(bucketSchedule)
+		if schedule == nil {
+			return nil
+		}
+		return schedule.ForEach(func(k, v []byte) error {
+			if name := scheduleKey(k).queue(); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+// SaveProperties stores the properties under "/" followed by the name since
+// bolt rejects the empty key of the root.
+func (d *Driver) SaveProperties(name string, b []byte) error {
+	return d.putValue(bucketProperties, "/"+name, b)
+}
+
+func (d *Driver) LoadProperties() (map[string][]byte, error) {
+	all, err := d.loadValues(bucketProperties)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(all))
+	for k, v := range all {
+		out[strings.TrimPrefix(k, "/")] = v
+	}
+	return out, nil
+}
+
+func (d *Driver) SaveSchedule(name string, b []byte) error {
+	return d.putValue(bucketRecurring, name, b)
+}
+
+func (d *Driver) LoadSchedules() (map[string][]byte, error) {
+	return d.loadValues(bucketRecurring)
+}
+
+// putValue stores b with the key in the bucket. Nil b removes the key.
+func (d *Driver) putValue(name []byte, key string, b []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return bucket.Delete([]byte(key))
+		}
+		return bucket.Put([]byte(key), b)
+	})
+}
+
+func (d *Driver) loadValues(name []byte) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			out[string(k)] = cloneBytes(v)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// Check verifies that a read transaction can be opened.
+func (d *Driver) Check() error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
 func (d *Driver) Close() error {
 	close(d.closed)
 	return d.db.Close()
 }
 
+// findReplyData returns the reply data of the leased message. The lease ends
+// the backoff before the message becomes available again.
 func (d *Driver) findReplyData(eid uid.ID) (rd replyData, err error) {
+	var backoff int64
 	err = d.db.View(func(tx *bolt.Tx) error {
 		ridx := tx.Bucket(bucketReplyIndex)
 		if ridx == nil {
@@ -362,9 +791,14 @@ func (d *Driver) findReplyData(eid uid.ID) (rd replyData, err error) {
 			return storage.ErrInvalidEphemeralID
 		}
 		rd = replyData(cloneBytes(v))
+		if schedule := tx.Bucket(bucketSchedule); schedule != nil {
+			if sv := schedule.Get(rd.scheduleID()); sv != nil {
+				backoff = scheduleData(sv).backoff()
+			}
+		}
 		return nil
 	})
-	if err == nil && rd.expireAt() <= time.Now().UnixNano() { // expired
+	if err == nil && rd.expireAt()-backoff <= time.Now().UnixNano() { // expired
 		err = storage.ErrInvalidEphemeralID
 	}
 	return
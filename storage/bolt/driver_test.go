@@ -0,0 +1,301 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+)
+
+func TestProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pluq.db")
+
+	d, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveProperties("a", []byte(`{"retry":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveProperties("b", []byte(`{"recurse":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveProperties("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveProperties("", []byte(`{"weight":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	if d, err = New(path); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	props, err := d.LoadProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props) != 2 || string(props["a"]) != `{"retry":3}` || string(props[""]) != `{"weight":2}` {
+		t.Errorf("unexpected properties: %q", props)
+	}
+}
+
+func TestAccumFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := New(filepath.Join(dir, "pluq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	opts := &storage.EnqueueOptions{AccumTime: types.Duration(time.Minute), AccumMaxBytes: 5}
+	for i, body := range []string{"abc", "de", "f"} {
+		e := storage.NewEnvelope()
+		e.Queue = "q"
+		e.ID = uid.ID(i + 1)
+		e.AddMessage(&storage.Message{Body: []byte(body)})
+		meta, err := d.Enqueue("q", e.ID, e, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i == 1; meta.Flushed != want {
+			t.Errorf("push %d: flushed = %v, want %v", i, meta.Flushed, want)
+		}
+	}
+	e, err := d.Dequeue("q", uid.ID(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Messages) != 2 || string(e.Messages[1].Body) != "de" {
+		t.Errorf("unexpected envelope: %+v", e)
+	}
+	if _, err := d.Dequeue("q", uid.ID(101)); err != storage.ErrEmpty {
+		t.Errorf("expected ErrEmpty but %v", err)
+	}
+}
+
+func TestAccumKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := New(filepath.Join(dir, "pluq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i, key := range []string{"a", "b", "a"} {
+		e := storage.NewEnvelope()
+		e.Queue = "q"
+		e.ID = uid.ID(i + 1)
+		e.AccumKey = key
+		e.AddMessage(&storage.Message{Body: []byte(key)})
+		opts := &storage.EnqueueOptions{AccumTime: types.Duration(20 * time.Millisecond), AccumKey: key}
+		if _, err := d.Enqueue("q", e.ID, e, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	counts := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		e, err := d.Dequeue("q", uid.ID(100+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[e.AccumKey] = len(e.Messages)
+	}
+	if counts["a"] != 2 || counts["b"] != 1 {
+		t.Errorf("unexpected envelopes: %v", counts)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := New(filepath.Join(dir, "pluq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	e := storage.NewEnvelope()
+	e.Queue = "q"
+	e.ID = uid.ID(1)
+	e.AddMessage(&storage.Message{Body: []byte("x")})
+	if _, err := d.Enqueue("q", e.ID, e, &storage.EnqueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		eid := uid.ID(100 + i)
+		if e, err = d.Dequeue("q", eid); err != nil {
+			t.Fatal(err)
+		}
+		if e.Attempts != i || e.MessageID != uid.ID(1) {
+			t.Errorf("attempts, message id = %d, %v, want %d, 1", e.Attempts, e.MessageID, i)
+		}
+		if i == 1 {
+			if _, err := d.Extend(eid, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Reset(uid.ID(102)); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = d.Dequeue("q", uid.ID(103)); err != nil {
+		t.Fatal(err)
+	}
+	if e.Attempts != 2 {
+		t.Errorf("attempts after reset = %d, want 2", e.Attempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := New(filepath.Join(dir, "pluq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.SetBackoff(func(e *storage.Envelope) time.Duration {
+		return 100 * time.Millisecond
+	})
+
+	e := storage.NewEnvelope()
+	e.Queue = "q"
+	e.ID = uid.ID(1)
+	e.AddMessage(&storage.Message{Body: []byte("x")})
+	if _, err := d.Enqueue("q", e.ID, e, &storage.EnqueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dequeue("q", uid.ID(101)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Extend(uid.ID(101), types.Duration(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Extend(uid.ID(101), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(uid.ID(101)); err != storage.ErrInvalidEphemeralID {
+		t.Errorf("Ack after release = %v, want %v", err, storage.ErrInvalidEphemeralID)
+	}
+	if _, err := d.Dequeue("q", uid.ID(102)); err != storage.ErrEmpty {
+		t.Errorf("Dequeue during backoff = %v, want %v", err, storage.ErrEmpty)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if e, err = d.Dequeue("q", uid.ID(103)); err != nil {
+		t.Fatal(err)
+	}
+	if e.Attempts != 2 {
+		t.Errorf("attempts = %d, want 2", e.Attempts)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pluq.db")
+
+	// Write records in the layout before the backoff was added: the
+	// accumulation key follows the fixed 40 bytes.
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		message, err := tx.CreateBucket(bucketMessage)
+		if err != nil {
+			return err
+		}
+		schedule, err := tx.CreateBucket(bucketSchedule)
+		if err != nil {
+			return err
+		}
+		for i, queue := range []string{"a", "b"} {
+			id := uid.ID(i + 1)
+			e := storage.NewEnvelope()
+			e.AddMessage(&storage.Message{Body: []byte(queue)})
+			b, err := marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := message.Put(id.Bytes(), b); err != nil {
+				return err
+			}
+			v := make([]byte, 40)
+			copy(v, id.Bytes())
+			binary.BigEndian.PutUint32(v[8:], 3)
+			binary.BigEndian.PutUint64(v[12:], uint64(time.Minute))
+			if queue == "b" {
+				v = append(v, "key"...)
+			}
+			skey := newScheduleKey(queue)
+			skey.setTimestamp(int64(i + 1))
+			if err := schedule.Put(skey, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	d, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.SetBackoff(func(e *storage.Envelope) time.Duration {
+		return time.Second
+	})
+	for i, c := range []struct {
+		queue, key string
+	}{{"a", ""}, {"b", "key"}} {
+		eid := uid.ID(101 + i)
+		e, err := d.Dequeue(c.queue, eid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.AccumKey != c.key || e.Retry != 2 || e.Timeout != types.Duration(time.Minute) {
+			t.Errorf("unexpected envelope of %s: %+v", c.queue, e)
+		}
+		if _, err := d.Stats(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Ack(eid); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
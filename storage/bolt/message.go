@@ -6,7 +6,6 @@ import (
 
 	"github.com/tinylib/msgp/msgp"
 	"github.com/yosisa/pluq/storage"
-	"github.com/yosisa/pluq/types"
 )
 
 //go:generate msgp
@@ -44,10 +43,7 @@ func reconstruct(sd scheduleData, b []byte) (*storage.Envelope, error) {
 	if err != nil {
 		return nil, err
 	}
-	envelope := &storage.Envelope{
-		Retry:   sd.retry(),
-		Timeout: types.Duration(sd.timeout()),
-	}
+	envelope := sd.envelope()
 	for _, m := range ms {
 		envelope.AddMessage(&storage.Message{
 			ContentType: m.ContentType,
@@ -57,3 +53,18 @@ func reconstruct(sd scheduleData, b []byte) (*storage.Envelope, error) {
 	}
 	return envelope, nil
 }
+
+// containsDuplicate reports whether the serialized messages b contain a
+// duplicate of m.
+func containsDuplicate(b []byte, m *storage.Message) (bool, error) {
+	ms, err := unmarshal(b)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range ms {
+		if m.Duplicates(&storage.Message{Meta: v.Meta, Body: v.Body}) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
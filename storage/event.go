@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+)
+
+// MessageEvent is the payload of the message lifecycle events.
+type MessageEvent struct {
+	Type       event.EventType
+	Time       time.Time
+	Queue      string
+	MessageID  uid.ID
+	Retry      types.Retry
+	Attempts   int
+	EnqueuedAt time.Time
+	// Latency is the time from the enqueue to the event.
+	Latency time.Duration
+	// Envelope is a copy of the envelope of the event. It has no messages
+	// for the acked event.
+	Envelope *Envelope
+}
+
+// NewMessageEvent makes the event of a copy of the envelope so that drivers
+// can keep modifying the envelope.
+func NewMessageEvent(et event.EventType, e *Envelope) *MessageEvent {
+	now := time.Now()
+	copied := *e
+	copied.Messages = append([]*Message(nil), e.Messages...)
+	me := &MessageEvent{
+		Type:       et,
+		Time:       now,
+		Queue:      e.Queue,
+		MessageID:  e.MessageID,
+		Retry:      e.Retry,
+		Attempts:   e.Attempts,
+		EnqueuedAt: e.EnqueuedAt,
+		Envelope:   &copied,
+	}
+	if !e.EnqueuedAt.IsZero() {
+		me.Latency = now.Sub(e.EnqueuedAt)
+	}
+	return me
+}
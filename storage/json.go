@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+)
+
+// JSONMessage is the JSON representation of a message shared by the HTTP
+// API and webhooks. The body is inline if it is JSON, otherwise in base64.
+type JSONMessage struct {
+	ContentType string                 `json:"content_type,omitempty"`
+	Meta        map[string]interface{} `json:"meta,omitempty"`
+	Body        json.RawMessage        `json:"body,omitempty"`
+	BodyBase64  []byte                 `json:"body_base64,omitempty"`
+}
+
+func NewJSONMessage(msg *Message) *JSONMessage {
+	m := &JSONMessage{ContentType: msg.ContentType, Meta: msg.Meta}
+	if isJSON(msg.ContentType) && json.Valid(msg.Body) {
+		m.Body = msg.Body
+	} else {
+		m.BodyBase64 = msg.Body
+	}
+	return m
+}
+
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/yosisa/pluq/event"
 	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
 	"github.com/yosisa/pluq/uid"
 )
 
@@ -16,6 +17,16 @@ type message struct {
 	eid         uid.ID
 	removed     bool
 	accumlating bool
+	accumStart  int64
+	accumCount  int
+	accumBytes  int
+	backoff     int64
+}
+
+// leased reports whether the message is leased by eid. The lease ends the
+// backoff before the message becomes available again.
+func (m *message) leased(eid uid.ID, now int64) bool {
+	return m.eid == eid && m.availAt-m.backoff > now && !m.removed
 }
 
 type messageHeap []*message
@@ -72,6 +83,7 @@ func (q *queueIndex) get(name string) *messageHeap {
 type Driver struct {
 	queues         *queueIndex
 	ephemeralIndex map[uid.ID]*message
+	backoff        func(*storage.Envelope) time.Duration
 	m              sync.Mutex
 }
 
@@ -83,18 +95,48 @@ func New() *Driver {
 	return d
 }
 
+func (d *Driver) SetBackoff(f func(*storage.Envelope) time.Duration) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.backoff = f
+}
+
 func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *storage.EnqueueOptions) (*storage.EnqueueMeta, error) {
 	var meta storage.EnqueueMeta
 	msgs := d.queues.get(queue)
 	now := time.Now().UnixNano()
 
+	// Emit after unlocking since the handlers may call the driver.
+	var available bool
+	defer func() {
+		if available {
+			event.Emit(event.EventMessageAvailable, queue)
+		}
+	}()
 	d.m.Lock()
 	defer d.m.Unlock()
+	size := len(e.Messages[0].Body)
 	if opts.AccumTime > 0 {
-		for _, msg := range *msgs {
-			if msg.availAt > now && msg.accumlating {
+		for i, msg := range *msgs {
+			if msg.availAt > now && msg.accumlating && msg.envelope.AccumKey == opts.AccumKey {
+				if opts.AccumCoalesce && containsDuplicate(msg.envelope.Messages, e.Messages[0]) {
+					meta.AccumState = storage.AccumCoalesced
+					return &meta, nil
+				}
 				meta.AccumState = storage.AccumAdded
 				msg.envelope.AddMessage(e.Messages[0])
+				msg.accumCount++
+				msg.accumBytes += size
+				if opts.AccumFull(msg.accumCount, msg.accumBytes) {
+					meta.Flushed = true
+					msg.availAt = now
+					msg.accumlating = false
+					heap.Fix(msgs, i)
+					available = true
+				} else if opts.AccumMode == storage.AccumSliding {
+					msg.availAt = opts.AccumUntil(msg.accumStart, now)
+					heap.Fix(msgs, i)
+				}
 				return &meta, nil
 			}
 		}
@@ -105,19 +147,40 @@ func (d *Driver) Enqueue(queue string, id uid.ID, e *storage.Envelope, opts *sto
 		envelope: e,
 	}
 	if opts.AccumTime > 0 {
-		msg.availAt += int64(opts.AccumTime)
-		msg.accumlating = true
 		meta.AccumState = storage.AccumStarted
+		if opts.AccumFull(1, size) {
+			meta.Flushed = true
+		} else {
+			msg.availAt = opts.AccumUntil(now, now)
+			msg.accumlating = true
+			msg.accumStart = now
+			msg.accumCount = 1
+			msg.accumBytes = size
+		}
 	}
 	heap.Push(msgs, msg)
-	if opts.AccumTime == 0 {
-		event.Emit(event.EventMessageAvailable, queue)
-	}
+	available = !msg.accumlating
 	return &meta, nil
 }
 
+func containsDuplicate(msgs []*storage.Message, m *storage.Message) bool {
+	for _, v := range msgs {
+		if m.Duplicates(v) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err error) {
 	now := time.Now().UnixNano()
+	// Emit after unlocking since the handlers may call the driver.
+	var discarded []*storage.MessageEvent
+	defer func() {
+		for _, me := range discarded {
+			event.Emit(event.EventMessageDiscarded, me)
+		}
+	}()
 	d.m.Lock()
 	defer d.m.Unlock()
 	msgs := d.queues.get(queue)
@@ -127,7 +190,7 @@ func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err err
 			break
 		}
 		if !msg.envelope.Retry.IsValid() {
-			event.Emit(event.EventMessageDiscarded, msg.envelope)
+			discarded = append(discarded, storage.NewMessageEvent(event.EventMessageDiscarded, msg.envelope))
 			msg.removed = true
 		}
 		if msg.removed {
@@ -136,11 +199,18 @@ func (d *Driver) Dequeue(queue string, eid uid.ID) (e *storage.Envelope, err err
 			n--
 			continue
 		}
-		e = msg.envelope
 		msg.eid = eid
-		msg.availAt = now + int64(msg.envelope.Timeout)
 		msg.envelope.Retry.Decr()
+		msg.envelope.Attempts++
 		msg.accumlating = false
+		// The caller replaces the ID with the ephemeral ID.
+		copied := *msg.envelope
+		e = &copied
+		msg.backoff = 0
+		if d.backoff != nil {
+			msg.backoff = int64(d.backoff(&copied))
+		}
+		msg.availAt = now + int64(msg.envelope.Timeout) + msg.backoff
 		heap.Fix(msgs, i)
 		d.ephemeralIndex[eid] = msg
 		return
@@ -154,26 +224,53 @@ func (d *Driver) Ack(eid uid.ID) error {
 	d.m.Lock()
 	defer d.m.Unlock()
 	msg := d.ephemeralIndex[eid]
-	if msg == nil || msg.availAt <= now || msg.eid != eid || msg.removed {
+	if msg == nil || !msg.leased(eid, now) {
 		return storage.ErrInvalidEphemeralID
 	}
 	msg.removed = true // Actual removing is performed in dequeue
+	delete(d.ephemeralIndex, eid)
 	return nil
 }
 
+func (d *Driver) EnvelopeOf(eid uid.ID) (*storage.Envelope, error) {
+	now := time.Now().UnixNano()
+	d.m.Lock()
+	defer d.m.Unlock()
+	msg := d.ephemeralIndex[eid]
+	if msg == nil || !msg.leased(eid, now) {
+		return nil, storage.ErrInvalidEphemeralID
+	}
+	e := *msg.envelope
+	e.Messages = nil
+	return &e, nil
+}
+
+func (d *Driver) QueueOf(eid uid.ID) (string, error) {
+	now := time.Now().UnixNano()
+	d.m.Lock()
+	defer d.m.Unlock()
+	msg := d.ephemeralIndex[eid]
+	if msg == nil || !msg.leased(eid, now) {
+		return "", storage.ErrInvalidEphemeralID
+	}
+	return msg.envelope.Queue, nil
+}
+
 func (d *Driver) Reset(eid uid.ID) error {
 	now := time.Now().UnixNano()
 	d.m.Lock()
 	defer d.m.Unlock()
 	msg := d.ephemeralIndex[eid]
-	if msg == nil || msg.availAt <= now || msg.eid != eid || msg.removed {
+	if msg == nil || !msg.leased(eid, now) {
 		return storage.ErrInvalidEphemeralID
 	}
 	msgs := d.queues.get(msg.envelope.Queue)
 	for i, m := range *msgs {
 		if m == msg {
 			m.availAt = 0
+			m.backoff = 0
 			m.envelope.Retry.Incr()
+			m.envelope.Attempts--
 			heap.Fix(msgs, i)
 			return nil
 		}
@@ -181,6 +278,82 @@ func (d *Driver) Reset(eid uid.ID) error {
 	return storage.ErrInvalidEphemeralID
 }
 
+func (d *Driver) Extend(eid uid.ID, timeout types.Duration) (*storage.Envelope, error) {
+	now := time.Now().UnixNano()
+	var available string
+	defer func() {
+		if available != "" {
+			event.Emit(event.EventMessageAvailable, available)
+		}
+	}()
+	d.m.Lock()
+	defer d.m.Unlock()
+	msg := d.ephemeralIndex[eid]
+	if msg == nil || !msg.leased(eid, now) {
+		return nil, storage.ErrInvalidEphemeralID
+	}
+	msgs := d.queues.get(msg.envelope.Queue)
+	for i, m := range *msgs {
+		if m == msg {
+			m.availAt = now + int64(timeout) + m.backoff
+			heap.Fix(msgs, i)
+			if m.availAt == now {
+				available = msg.envelope.Queue
+			}
+			e := *msg.envelope
+			e.Messages = nil
+			return &e, nil
+		}
+	}
+	return nil, storage.ErrInvalidEphemeralID
+}
+
+func (d *Driver) Flush(queue string) (int, error) {
+	now := time.Now().UnixNano()
+	d.m.Lock()
+	msgs := d.queues.get(queue)
+	var n int
+	for _, msg := range *msgs {
+		if msg.accumlating && msg.availAt > now && !msg.removed {
+			msg.availAt = now
+			msg.accumlating = false
+			n++
+		}
+	}
+	if n > 0 {
+		heap.Init(msgs)
+	}
+	d.m.Unlock()
+	// Emit after unlocking since the handlers may dequeue from the driver.
+	for i := 0; i < n; i++ {
+		event.Emit(event.EventMessageAvailable, queue)
+	}
+	return n, nil
+}
+
+func (d *Driver) Stats() (map[string]*storage.QueueStats, error) {
+	now := time.Now().UnixNano()
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.queues.m.Lock()
+	defer d.queues.m.Unlock()
+	out := make(map[string]*storage.QueueStats)
+	for name, msgs := range d.queues.index {
+		stats := &storage.QueueStats{}
+		for _, msg := range *msgs {
+			switch {
+			case msg.removed:
+			case msg.eid != 0 && msg.availAt-msg.backoff > now && !msg.accumlating:
+				stats.InFlight++
+			default:
+				stats.Depth++
+			}
+		}
+		out[name] = stats
+	}
+	return out, nil
+}
+
 func (d *Driver) Close() error {
 	return nil
 }
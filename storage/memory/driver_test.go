@@ -0,0 +1,166 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
+	"github.com/yosisa/pluq/uid"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DriverSuite struct{}
+
+var _ = Suite(&DriverSuite{})
+
+func enqueue(c *C, d *Driver, id int, body string, opts *storage.EnqueueOptions) *storage.EnqueueMeta {
+	e := storage.NewEnvelope()
+	e.Queue = "q"
+	e.ID = uid.ID(id)
+	e.MessageID = e.ID
+	e.AccumKey = opts.AccumKey
+	e.AddMessage(&storage.Message{Body: []byte(body)})
+	meta, err := d.Enqueue("q", e.ID, e, opts)
+	c.Assert(err, IsNil)
+	return meta
+}
+
+func (s *DriverSuite) TestAccumFlush(c *C) {
+	d := New()
+	opts := &storage.EnqueueOptions{AccumTime: types.Duration(time.Minute), AccumMaxMessages: 3, AccumMaxBytes: 5}
+	var flushed []bool
+	for i, body := range []string{"abc", "de", "f"} {
+		flushed = append(flushed, enqueue(c, d, i+1, body, opts).Flushed)
+	}
+	c.Assert(flushed, DeepEquals, []bool{false, true, false})
+	e, err := d.Dequeue("q", uid.ID(100))
+	c.Assert(err, IsNil)
+	c.Assert(e.Messages, HasLen, 2)
+	_, err = d.Dequeue("q", uid.ID(101))
+	c.Assert(err, Equals, storage.ErrEmpty)
+
+	opts.AccumMaxBytes = 0
+	for i := 0; i < 3; i++ {
+		enqueue(c, d, 10+i, "x", opts)
+	}
+	e, err = d.Dequeue("q", uid.ID(102))
+	c.Assert(err, IsNil)
+	c.Assert(e.Messages, HasLen, 3)
+}
+
+func (s *DriverSuite) TestAccumKey(c *C) {
+	d := New()
+	for i, key := range []string{"a", "b", "a"} {
+		opts := &storage.EnqueueOptions{AccumTime: types.Duration(20 * time.Millisecond), AccumKey: key}
+		enqueue(c, d, i+1, key, opts)
+	}
+	time.Sleep(30 * time.Millisecond)
+	counts := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		e, err := d.Dequeue("q", uid.ID(100+i))
+		c.Assert(err, IsNil)
+		counts[e.AccumKey] = len(e.Messages)
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"a": 2, "b": 1})
+}
+
+func (s *DriverSuite) TestFlush(c *C) {
+	d := New()
+	opts := &storage.EnqueueOptions{AccumTime: types.Duration(time.Minute)}
+	for i := 0; i < 2; i++ {
+		enqueue(c, d, i+1, "x", opts)
+	}
+	_, err := d.Dequeue("q", uid.ID(100))
+	c.Assert(err, Equals, storage.ErrEmpty)
+	n, err := d.Flush("q")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	e, err := d.Dequeue("q", uid.ID(101))
+	c.Assert(err, IsNil)
+	c.Assert(e.Messages, HasLen, 2)
+	n, err = d.Flush("q")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *DriverSuite) TestCoalesce(c *C) {
+	d := New()
+	opts := &storage.EnqueueOptions{AccumTime: types.Duration(time.Minute), AccumCoalesce: true}
+	var states []storage.AccumState
+	for i, m := range []*storage.Message{
+		{Body: []byte("same")},
+		{Body: []byte("same")},
+		{Body: []byte("same"), Meta: map[string]interface{}{storage.MetaDedupKey: "k"}},
+		{Body: []byte("other"), Meta: map[string]interface{}{storage.MetaDedupKey: "k"}},
+	} {
+		e := storage.NewEnvelope()
+		e.Queue = "q"
+		e.ID = uid.ID(i + 1)
+		e.AddMessage(m)
+		meta, err := d.Enqueue("q", e.ID, e, opts)
+		c.Assert(err, IsNil)
+		states = append(states, meta.AccumState)
+	}
+	c.Assert(states, DeepEquals, []storage.AccumState{
+		storage.AccumStarted, storage.AccumCoalesced, storage.AccumAdded, storage.AccumCoalesced,
+	})
+	_, err := d.Flush("q")
+	c.Assert(err, IsNil)
+	e, err := d.Dequeue("q", uid.ID(100))
+	c.Assert(err, IsNil)
+	c.Assert(e.Messages, HasLen, 2)
+}
+
+func (s *DriverSuite) TestBackoff(c *C) {
+	d := New()
+	d.SetBackoff(func(e *storage.Envelope) time.Duration {
+		return time.Duration(e.Attempts) * 50 * time.Millisecond
+	})
+	enqueue(c, d, 1, "x", &storage.EnqueueOptions{})
+	_, err := d.Dequeue("q", uid.ID(100))
+	c.Assert(err, IsNil)
+	_, err = d.Extend(uid.ID(100), 0)
+	c.Assert(err, IsNil)
+	c.Assert(d.Ack(uid.ID(100)), Equals, storage.ErrInvalidEphemeralID)
+	_, err = d.Dequeue("q", uid.ID(101))
+	c.Assert(err, Equals, storage.ErrEmpty)
+	time.Sleep(70 * time.Millisecond)
+
+	// The lease of the second attempt expires before its backoff.
+	e, err := d.Dequeue("q", uid.ID(102))
+	c.Assert(err, IsNil)
+	c.Assert(e.Attempts, Equals, 2)
+	_, err = d.Extend(uid.ID(102), types.Duration(20*time.Millisecond))
+	c.Assert(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(d.Ack(uid.ID(102)), Equals, storage.ErrInvalidEphemeralID)
+	_, err = d.Dequeue("q", uid.ID(103))
+	c.Assert(err, Equals, storage.ErrEmpty)
+	time.Sleep(100 * time.Millisecond)
+	e, err = d.Dequeue("q", uid.ID(104))
+	c.Assert(err, IsNil)
+	c.Assert(e.Attempts, Equals, 3)
+}
+
+func (s *DriverSuite) TestDeliveryInfo(c *C) {
+	d := New()
+	enqueue(c, d, 1, "x", &storage.EnqueueOptions{})
+	for i := 1; i <= 2; i++ {
+		eid := uid.ID(100 + i)
+		e, err := d.Dequeue("q", eid)
+		c.Assert(err, IsNil)
+		c.Assert(e.Attempts, Equals, i)
+		c.Assert(e.MessageID, Equals, uid.ID(1))
+		_, err = d.Extend(eid, 0)
+		c.Assert(err, IsNil)
+	}
+	_, err := d.Dequeue("q", uid.ID(103))
+	c.Assert(err, IsNil)
+	c.Assert(d.Reset(uid.ID(103)), IsNil)
+	e, err := d.Dequeue("q", uid.ID(104))
+	c.Assert(err, IsNil)
+	c.Assert(e.Attempts, Equals, 3)
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/yosisa/pluq/types"
@@ -13,10 +14,19 @@ var (
 )
 
 type Envelope struct {
-	ID       uid.ID
-	Queue    string
-	Retry    types.Retry
-	Timeout  types.Duration
+	// ID is the message ID on enqueue, and the ephemeral ID to reply with
+	// on dequeue.
+	ID uid.ID
+	// MessageID is the message ID which stays the same across deliveries.
+	MessageID  uid.ID
+	Queue      string
+	Retry      types.Retry
+	Timeout    types.Duration
+	EnqueuedAt time.Time
+	AccumKey   string
+	// Attempts is the number of deliveries of the envelope including the
+	// current one.
+	Attempts int
 	Messages []*Message
 }
 
@@ -40,3 +50,20 @@ type Message struct {
 	Meta        map[string]interface{}
 	Body        []byte
 }
+
+// MetaDedupKey is the meta key holding the deduplication key of a message.
+const MetaDedupKey = "dedup_key"
+
+func (m *Message) DedupKey() string {
+	s, _ := m.Meta[MetaDedupKey].(string)
+	return s
+}
+
+// Duplicates reports whether m is a duplicate of other. Messages having a
+// dedup key are compared by the key, otherwise by the body.
+func (m *Message) Duplicates(other *Message) bool {
+	if key := m.DedupKey(); key != "" {
+		return key == other.DedupKey()
+	}
+	return other.DedupKey() == "" && bytes.Equal(m.Body, other.Body)
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"time"
 
 	"github.com/yosisa/pluq/types"
 	"github.com/yosisa/pluq/uid"
@@ -21,6 +22,14 @@ type Driver interface {
 	Close() error
 }
 
+// Extender is implemented by drivers that can change the lease of a dequeued
+// message.
+type Extender interface {
+	// Extend makes the message invisible for the duration from now and
+	// returns its envelope without messages. Zero duration releases it.
+	Extend(uid.ID, types.Duration) (*Envelope, error)
+}
+
 type MultiEnqueuer interface {
 	EnqueueAll([]*Envelope, []*EnqueueOptions) (map[string]*EnqueueMeta, error)
 }
@@ -29,8 +38,146 @@ type MultiDequeuer interface {
 	DequeueAny([]string, uid.ID) (*Envelope, error)
 }
 
+// Backoffer is implemented by drivers that can delay the redelivery of a
+// message whose lease ended.
+type Backoffer interface {
+	// SetBackoff sets the function that returns the delay before the
+	// message of the dequeued envelope becomes available again. The delay
+	// is applied once when the lease expires or is released by Extend with
+	// zero duration.
+	SetBackoff(func(*Envelope) time.Duration)
+}
+
+// QueueResolver is implemented by drivers that can tell the queue of a
+// dequeued message by its ephemeral ID.
+type QueueResolver interface {
+	QueueOf(uid.ID) (string, error)
+}
+
+// EnvelopeResolver is implemented by drivers that can return the envelope,
+// without messages, of a dequeued message by its ephemeral ID.
+type EnvelopeResolver interface {
+	EnvelopeOf(uid.ID) (*Envelope, error)
+}
+
+// StatsProvider is implemented by drivers that can report the number of
+// messages per queue.
+type StatsProvider interface {
+	Stats() (map[string]*QueueStats, error)
+}
+
+// Checker is implemented by drivers that can verify that the underlying
+// storage is usable.
+type Checker interface {
+	Check() error
+}
+
+// Flusher is implemented by drivers that can close accumulation windows
+// before their time.
+type Flusher interface {
+	// Flush makes the accumulating envelopes of the queue available now and
+	// returns the number of them.
+	Flush(queue string) (int, error)
+}
+
+// QueueLister is implemented by persistent drivers that can list the names
+// of the queues holding messages.
+type QueueLister interface {
+	Queues() ([]string, error)
+}
+
+// PropertyStore is implemented by drivers that can persist queue
+// properties. Properties are stored as opaque bytes per queue name.
+type PropertyStore interface {
+	// SaveProperties stores the properties of the queue. Nil b removes
+	// them.
+	SaveProperties(name string, b []byte) error
+	LoadProperties() (map[string][]byte, error)
+}
+
+// ScheduleStore is implemented by drivers that can persist schedules of
+// recurring messages. Schedules are stored as opaque bytes per name.
+type ScheduleStore interface {
+	// SaveSchedule stores the schedule. Nil b removes it.
+	SaveSchedule(name string, b []byte) error
+	LoadSchedules() (map[string][]byte, error)
+}
+
+type QueueStats struct {
+	// Depth is the number of messages waiting for delivery.
+	Depth int
+	// InFlight is the number of messages delivered but not acked yet.
+	InFlight int
+}
+
 type EnqueueOptions struct {
 	AccumTime types.Duration
+	// AccumMode decides when an accumulation window closes.
+	AccumMode AccumMode
+	// AccumMaxWait bounds the window extended by AccumSliding from its
+	// start. Zero means no limit.
+	AccumMaxWait types.Duration
+	// AccumKey separates accumulation windows of a queue. Messages join
+	// only the window of the same key.
+	AccumKey string
+	// AccumMaxMessages and AccumMaxBytes make an accumulating envelope
+	// available as soon as it reaches either limit. Zero means no limit.
+	AccumMaxMessages int
+	AccumMaxBytes    int
+	// AccumCoalesce drops a message if a duplicate of it is already in the
+	// accumulating envelope.
+	AccumCoalesce bool
+}
+
+// AccumUntil returns the time when the accumulation window started at start
+// closes after a push at now. Times are in nanoseconds.
+func (o *EnqueueOptions) AccumUntil(start, now int64) int64 {
+	d := int64(o.AccumTime)
+	switch o.AccumMode {
+	case AccumSliding:
+		t := now + d
+		if max := start + int64(o.AccumMaxWait); o.AccumMaxWait > 0 && t > max {
+			t = max
+		}
+		return t
+	case AccumAligned:
+		return start - start%d + d
+	}
+	return start + d
+}
+
+// AccumFull reports whether an accumulating envelope having n messages of
+// size bytes in total reaches the limits.
+func (o *EnqueueOptions) AccumFull(n, size int) bool {
+	return (o.AccumMaxMessages > 0 && n >= o.AccumMaxMessages) ||
+		(o.AccumMaxBytes > 0 && size >= o.AccumMaxBytes)
+}
+
+type AccumMode int
+
+const (
+	// AccumFixed closes the window AccumTime after the first push.
+	AccumFixed AccumMode = iota
+	// AccumSliding extends the window by AccumTime on every push up to
+	// AccumMaxWait from the first push.
+	AccumSliding
+	// AccumAligned closes the window at the next multiple of AccumTime in
+	// wall-clock time.
+	AccumAligned
+)
+
+var ErrInvalidAccumMode = errors.New("Error invalid accumulation mode")
+
+func ParseAccumMode(s string) (AccumMode, error) {
+	switch s {
+	case "", "fixed":
+		return AccumFixed, nil
+	case "sliding":
+		return AccumSliding, nil
+	case "aligned":
+		return AccumAligned, nil
+	}
+	return AccumFixed, ErrInvalidAccumMode
 }
 
 type AccumState int
@@ -39,10 +186,14 @@ const (
 	AccumDisabled AccumState = iota
 	AccumStarted
 	AccumAdded
+	AccumCoalesced
 )
 
 type EnqueueMeta struct {
 	AccumState AccumState
+	// Flushed is true if the accumulating envelope became available by the
+	// push.
+	Flushed bool
 }
 
 type key int
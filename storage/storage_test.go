@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/types"
+)
+
+func TestAccumUntil(t *testing.T) {
+	sec := int64(time.Second)
+	for _, c := range []struct {
+		opts       EnqueueOptions
+		start, now int64
+		want       int64
+	}{
+		{EnqueueOptions{AccumTime: types.Duration(time.Second)}, 10 * sec, 12 * sec, 11 * sec},
+		{EnqueueOptions{AccumTime: types.Duration(time.Second), AccumMode: AccumSliding}, 10 * sec, 12 * sec, 13 * sec},
+		{EnqueueOptions{AccumTime: types.Duration(time.Second), AccumMode: AccumSliding, AccumMaxWait: types.Duration(2 * time.Second)}, 10 * sec, 12 * sec, 12 * sec},
+		{EnqueueOptions{AccumTime: types.Duration(time.Minute), AccumMode: AccumAligned}, 70 * sec, 70 * sec, 120 * sec},
+		{EnqueueOptions{AccumTime: types.Duration(time.Minute), AccumMode: AccumAligned}, 120 * sec, 120 * sec, 180 * sec},
+	} {
+		if got := c.opts.AccumUntil(c.start, c.now); got != c.want {
+			t.Errorf("AccumUntil(%d, %d) with %+v = %d, want %d", c.start, c.now, c.opts, got, c.want)
+		}
+	}
+}
+
+func TestParseAccumMode(t *testing.T) {
+	for s, want := range map[string]AccumMode{"": AccumFixed, "fixed": AccumFixed, "sliding": AccumSliding, "aligned": AccumAligned} {
+		if got, err := ParseAccumMode(s); err != nil || got != want {
+			t.Errorf("ParseAccumMode(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseAccumMode("x"); err != ErrInvalidAccumMode {
+		t.Errorf("expected ErrInvalidAccumMode but %v", err)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	keyed := func(key, body string) *Message {
+		return &Message{Meta: map[string]interface{}{MetaDedupKey: key}, Body: []byte(body)}
+	}
+	for _, c := range []struct {
+		a, b *Message
+		want bool
+	}{
+		{&Message{Body: []byte("x")}, &Message{Body: []byte("x")}, true},
+		{&Message{Body: []byte("x")}, &Message{Body: []byte("y")}, false},
+		{keyed("k", "x"), keyed("k", "y"), true},
+		{keyed("k", "x"), keyed("l", "x"), false},
+		{&Message{Body: []byte("x")}, keyed("k", "x"), false},
+	} {
+		if got := c.a.Duplicates(c.b); got != c.want {
+			t.Errorf("%+v.Duplicates(%+v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestNewMessageEvent(t *testing.T) {
+	e := NewEnvelope()
+	e.AddMessage(&Message{Body: []byte("a")})
+	me := NewMessageEvent(event.EventMessagePushed, e)
+	e.AddMessage(&Message{Body: []byte("b")})
+	e.Retry.Decr()
+	e.Attempts++
+	if len(me.Envelope.Messages) != 1 || me.Envelope.Retry != DefaultRetry || me.Envelope.Attempts != 0 {
+		t.Errorf("event envelope is modified: %+v", me.Envelope)
+	}
+}
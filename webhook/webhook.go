@@ -0,0 +1,253 @@
+// Package webhook notifies HTTP endpoints of message lifecycle events.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
+)
+
+var (
+	ErrNoURL            = errors.New("Error webhook has no url")
+	ErrInvalidEvent     = errors.New("Error invalid webhook event")
+	ErrUnsupportedEvent = errors.New("Error unsupported webhook event: queues have no dead letters or expiry")
+)
+
+var (
+	DefaultTimeout = 5 * time.Second
+	retryInterval  = time.Second
+)
+
+// Events that can be notified. Discarded is for an envelope dropped after
+// exhausting its retries, and acked is for an envelope processed by a
+// consumer. Queues neither dead-letter nor expire messages, so there are no
+// events for them.
+const (
+	EventDiscarded = "discarded"
+	EventAcked     = "acked"
+)
+
+// unsupportedEvents are the names of events which are not available yet.
+var unsupportedEvents = map[string]bool{
+	"dead-lettered": true,
+	"expired":       true,
+}
+
+var eventNames = map[event.EventType]string{
+	event.EventMessageDiscarded: EventDiscarded,
+	event.EventMessageProceeded: EventAcked,
+}
+
+// Hook posts notifications of Events of the queues under Prefix to URL. An
+// empty Prefix matches all queues. A failed post is retried up to Retry
+// times.
+type Hook struct {
+	URL     string
+	Prefix  string
+	Events  []string
+	Timeout time.Duration
+	Retry   int
+}
+
+func (h *Hook) validate() error {
+	if h.URL == "" {
+		return ErrNoURL
+	}
+	for _, name := range h.Events {
+		switch {
+		case name == EventDiscarded || name == EventAcked:
+		case unsupportedEvents[name]:
+			return ErrUnsupportedEvent
+		default:
+			return ErrInvalidEvent
+		}
+	}
+	return nil
+}
+
+func (h *Hook) match(name, queue string) bool {
+	prefix := strings.Trim(h.Prefix, "/")
+	if prefix != "" && queue != prefix && !strings.HasPrefix(queue, prefix+"/") {
+		return false
+	}
+	for _, v := range h.Events {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification is the JSON body posted to webhooks.
+type Notification struct {
+	Event         string                 `json:"event"`
+	Time          time.Time              `json:"time"`
+	Queue         string                 `json:"queue"`
+	MessageID     string                 `json:"message_id,omitempty"`
+	Retry         types.Retry            `json:"retry"`
+	DeliveryCount int                    `json:"delivery_count"`
+	EnqueuedAt    *time.Time             `json:"enqueued_at,omitempty"`
+	Messages      []*storage.JSONMessage `json:"messages,omitempty"`
+}
+
+func newNotification(name string, me *storage.MessageEvent) *Notification {
+	n := &Notification{
+		Event:         name,
+		Time:          me.Time,
+		Queue:         me.Queue,
+		Retry:         me.Retry,
+		DeliveryCount: me.Attempts,
+	}
+	if me.MessageID != 0 {
+		n.MessageID = me.MessageID.HashID()
+	}
+	if !me.EnqueuedAt.IsZero() {
+		n.EnqueuedAt = &me.EnqueuedAt
+	}
+	for _, m := range me.Envelope.Messages {
+		n.Messages = append(n.Messages, storage.NewJSONMessage(m))
+	}
+	return n
+}
+
+// worker posts notifications to a hook so that a slow endpoint does not
+// delay the others.
+type worker struct {
+	hook  *Hook
+	queue chan []byte
+}
+
+// Notifier posts notifications in the background so that the event
+// dispatcher is never blocked. Notifications are dropped if too many are
+// pending for a hook.
+type Notifier struct {
+	workers []*worker
+	client  *http.Client
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func New(hooks []*Hook) (*Notifier, error) {
+	for _, h := range hooks {
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = DefaultTimeout
+		}
+	}
+	n := &Notifier{
+		client: &http.Client{},
+		quit:   make(chan struct{}),
+	}
+	for _, h := range hooks {
+		w := &worker{hook: h, queue: make(chan []byte, 1000)}
+		n.workers = append(n.workers, w)
+		n.wg.Add(1)
+		go n.run(w)
+	}
+	return n, nil
+}
+
+// Register subscribes the notifier to the events.
+func (n *Notifier) Register() {
+	for et := range eventNames {
+		event.Handle(et, n)
+	}
+}
+
+func (n *Notifier) HandleEvent(et event.EventType, v interface{}) {
+	name, ok := eventNames[et]
+	if !ok {
+		return
+	}
+	me, ok := v.(*storage.MessageEvent)
+	if !ok {
+		return
+	}
+	var body []byte
+	for _, w := range n.workers {
+		if !w.hook.match(name, me.Queue) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(newNotification(name, me)); err != nil {
+				log.Printf("Failed to encode webhook notification: %v", err)
+				return
+			}
+		}
+		select {
+		case w.queue <- body:
+		default:
+			log.Printf("Dropped %s notification of %s to %s", name, me.Queue, w.hook.URL)
+		}
+	}
+}
+
+func (n *Notifier) run(w *worker) {
+	defer n.wg.Done()
+	for {
+		select {
+		case body := <-w.queue:
+			n.deliver(w.hook, body)
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+func (n *Notifier) deliver(h *Hook, body []byte) {
+	interval := retryInterval
+	for i := 0; ; i++ {
+		err := n.post(h, body)
+		if err == nil {
+			return
+		}
+		if i >= h.Retry {
+			log.Printf("Failed to post webhook to %s: %v", h.URL, err)
+			return
+		}
+		select {
+		case <-time.After(interval):
+			interval *= 2
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+func (n *Notifier) post(h *Hook, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c := *n.client
+	c.Timeout = h.Timeout
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops posting. Pending notifications are dropped.
+func (n *Notifier) Close() {
+	close(n.quit)
+	n.wg.Wait()
+}
@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yosisa/pluq/event"
+	"github.com/yosisa/pluq/storage"
+	"github.com/yosisa/pluq/types"
+)
+
+func TestMatch(t *testing.T) {
+	h := &Hook{Prefix: "jobs/", Events: []string{EventDiscarded}}
+	for _, c := range []struct {
+		event, queue string
+		expected     bool
+	}{
+		{EventDiscarded, "jobs", true},
+		{EventDiscarded, "jobs/a", true},
+		{EventDiscarded, "jobsx", false},
+		{EventAcked, "jobs/a", false},
+	} {
+		if got := h.match(c.event, c.queue); got != c.expected {
+			t.Errorf("match(%q, %q) = %v, want %v", c.event, c.queue, got, c.expected)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	retryInterval = time.Millisecond
+	notified := make(chan *Notification, 1)
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		notified <- &n
+	}))
+	defer ts.Close()
+
+	n, err := New([]*Hook{{URL: ts.URL, Events: []string{EventDiscarded}, Retry: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	e := &storage.Envelope{Queue: "jobs", Retry: types.Retry(0), Attempts: 3}
+	e.AddMessage(&storage.Message{Body: []byte("poison")})
+	e.AddMessage(&storage.Message{ContentType: "application/json", Body: []byte(`{"a":1}`)})
+	n.HandleEvent(event.EventMessageProceeded, storage.NewMessageEvent(event.EventMessageProceeded, e))
+	n.HandleEvent(event.EventMessageDiscarded, storage.NewMessageEvent(event.EventMessageDiscarded, e))
+
+	select {
+	case got := <-notified:
+		if got.Event != EventDiscarded || got.Queue != "jobs" || got.DeliveryCount != 3 {
+			t.Errorf("unexpected notification: %+v", got)
+		}
+		if string(got.Messages[0].BodyBase64) != "poison" || string(got.Messages[1].Body) != `{"a":1}` {
+			t.Errorf("unexpected notification: %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification")
+	}
+}
+
+func TestSlowHook(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	notified := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified <- struct{}{}
+	}))
+	defer fast.Close()
+
+	n, err := New([]*Hook{
+		{URL: slow.URL, Events: []string{EventDiscarded}},
+		{URL: fast.URL, Events: []string{EventDiscarded}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	defer close(release)
+	e := &storage.Envelope{Queue: "jobs"}
+	e.AddMessage(&storage.Message{Body: []byte("x")})
+	for i := 0; i < 2; i++ {
+		n.HandleEvent(event.EventMessageDiscarded, storage.NewMessageEvent(event.EventMessageDiscarded, e))
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Fatal("blocked by the slow hook")
+		}
+	}
+}
+
+func TestInvalidEvent(t *testing.T) {
+	for _, c := range []struct {
+		event string
+		err   error
+	}{
+		{"expired", ErrUnsupportedEvent},
+		{"dead-lettered", ErrUnsupportedEvent},
+		{"popped", ErrInvalidEvent},
+	} {
+		if _, err := New([]*Hook{{URL: "http://localhost/", Events: []string{c.event}}}); err != c.err {
+			t.Errorf("Expected %v for %s but %v", c.err, c.event, err)
+		}
+	}
+}